@@ -0,0 +1,65 @@
+package main
+
+import (
+	"math/rand/v2"
+	"time"
+)
+
+// Supported values for the backoffStrategy config field.
+const (
+	backoffFixed       = "fixed"
+	backoffLinear      = "linear"
+	backoffExponential = "exponential"
+)
+
+// BackoffStrategy decides how long callDoApi waits before retrying a failed
+// request. attempt is the number of the attempt that failed, starting at 1.
+type BackoffStrategy interface {
+	NextDelay(attempt int) time.Duration
+}
+
+// fixedBackoff waits the same delay before every retry.
+type fixedBackoff struct {
+	delay time.Duration
+}
+
+func (b fixedBackoff) NextDelay(int) time.Duration {
+	return b.delay
+}
+
+// linearBackoff waits base longer with every retry.
+type linearBackoff struct {
+	base time.Duration
+}
+
+func (b linearBackoff) NextDelay(attempt int) time.Duration {
+	return b.base * time.Duration(attempt)
+}
+
+// exponentialBackoff doubles the delay with every retry, with jitter applied
+// to the upper half of the interval.
+type exponentialBackoff struct {
+	base time.Duration
+}
+
+func (b exponentialBackoff) NextDelay(attempt int) time.Duration {
+	d := b.base << (attempt - 1)
+	if d <= 0 {
+		return b.base
+	}
+	half := d / 2
+	return half + rand.N(half+1)
+}
+
+// newBackoffStrategy returns the strategy named by the backoffStrategy config
+// field, with base as its first delay. Unknown names fall back to
+// exponential backoff; loadConfig rejects them before.
+func newBackoffStrategy(name string, base time.Duration) BackoffStrategy {
+	switch name {
+	case backoffFixed:
+		return fixedBackoff{delay: base}
+	case backoffLinear:
+		return linearBackoff{base: base}
+	}
+	return exponentialBackoff{base: base}
+}
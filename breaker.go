@@ -0,0 +1,162 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"k8s.io/klog/v2"
+)
+
+const defaultBreakerCooldown = 30 * time.Second
+
+// circuitBreakers holds one circuit breaker per API host, so a fallback
+// endpoint stays usable while the primary one is failing. Hosts read from a
+// secret share the breaker of redactedPlaceholder, so they do not show up
+// in logs and metric labels.
+type circuitBreakers struct {
+	threshold int
+	cooldown  time.Duration
+	now       func() time.Time
+
+	mu     sync.Mutex
+	byHost map[string]*circuitBreaker
+}
+
+// newCircuitBreakersFromEnv returns breakers that open after
+// API_BREAKER_THRESHOLD consecutive failures of a host and stay open for
+// API_BREAKER_COOLDOWN, 30s by default. It returns nil if
+// API_BREAKER_THRESHOLD is not set.
+func newCircuitBreakersFromEnv() (*circuitBreakers, error) {
+	v := os.Getenv("API_BREAKER_THRESHOLD")
+	if v == "" {
+		return nil, nil
+	}
+	threshold, err := strconv.Atoi(v)
+	if err != nil || threshold < 1 {
+		return nil, fmt.Errorf("API_BREAKER_THRESHOLD must be a positive integer, got %q", v)
+	}
+
+	cooldown := defaultBreakerCooldown
+	if v := os.Getenv("API_BREAKER_COOLDOWN"); v != "" {
+		cooldown, err = time.ParseDuration(v)
+		if err != nil || cooldown <= 0 {
+			return nil, fmt.Errorf("API_BREAKER_COOLDOWN must be a positive duration, got %q", v)
+		}
+	}
+	return newCircuitBreakers(threshold, cooldown), nil
+}
+
+func newCircuitBreakers(threshold int, cooldown time.Duration) *circuitBreakers {
+	return &circuitBreakers{threshold: threshold, cooldown: cooldown, now: time.Now, byHost: map[string]*circuitBreaker{}}
+}
+
+func (s *circuitBreakers) get(host string) *circuitBreaker {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	b, ok := s.byHost[host]
+	if !ok {
+		b = &circuitBreaker{host: host, threshold: s.threshold, cooldown: s.cooldown, now: s.now}
+		s.byHost[host] = b
+		apiCircuitOpen.WithLabelValues(host).Set(0)
+	}
+	return b
+}
+
+// circuitBreaker counts consecutive failures of an API host. Once threshold
+// is reached it opens and rejects requests for cooldown, then lets a single
+// probe request through: it closes again if the probe succeeds and stays
+// open for another cooldown otherwise.
+type circuitBreaker struct {
+	host      string
+	threshold int
+	cooldown  time.Duration
+	now       func() time.Time
+
+	mu        sync.Mutex
+	failures  int
+	openUntil time.Time
+	probing   bool
+}
+
+func (b *circuitBreaker) open() bool {
+	return b.failures >= b.threshold
+}
+
+// allow reports whether a request may be sent now.
+func (b *circuitBreaker) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !b.open() {
+		return true
+	}
+	if b.probing || b.now().Before(b.openUntil) {
+		return false
+	}
+	b.probing = true
+	klog.Infof("api circuit breaker for %s: cooldown over, sending a probe request", b.host)
+	return true
+}
+
+// record reports the outcome of a request that allow admitted.
+func (b *circuitBreaker) record(success bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	wasOpen := b.open()
+	b.probing = false
+	if success {
+		b.failures = 0
+		if wasOpen {
+			klog.Infof("api circuit breaker for %s closed", b.host)
+			apiCircuitOpen.WithLabelValues(b.host).Set(0)
+		}
+		return
+	}
+
+	b.failures++
+	if b.open() {
+		b.openUntil = b.now().Add(b.cooldown)
+		if !wasOpen {
+			klog.Warningf("api circuit breaker for %s opened after %d consecutive failures, failing fast for %v", b.host, b.failures, b.cooldown)
+			apiCircuitOpen.WithLabelValues(b.host).Set(1)
+		} else {
+			klog.Warningf("api circuit breaker for %s: probe request failed, failing fast for another %v", b.host, b.cooldown)
+		}
+	}
+}
+
+// abort releases a probe whose request was cancelled by the caller; it says
+// nothing about the health of the host.
+func (b *circuitBreaker) abort() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.probing = false
+}
+
+// breakerTransport rejects requests to hosts whose circuit breaker is open.
+// Connection errors and 5xx responses count as failures.
+type breakerTransport struct {
+	next     http.RoundTripper
+	breakers *circuitBreakers
+}
+
+func (t *breakerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	host := shownHost(req.Context(), req.URL.Host)
+	b := t.breakers.get(host)
+	if !b.allow() {
+		return nil, fmt.Errorf("%w for %s", ErrCircuitOpen, host)
+	}
+	resp, err := t.next.RoundTrip(req)
+	switch {
+	case err != nil && req.Context().Err() != nil:
+		b.abort()
+	case err != nil || resp.StatusCode >= http.StatusInternalServerError:
+		b.record(false)
+	default:
+		b.record(true)
+	}
+	return resp, err
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/cert-manager/cert-manager/pkg/acme/webhook/apis/acme/v1alpha1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/klog/v2"
+)
+
+// CredentialProvider supplies the raw API token for a challenge in
+// namespace. Present and CleanUp only obtain tokens through it, so further
+// sources, e.g. Vault, can be added in credentialProvider alone.
+type CredentialProvider interface {
+	Token(ctx context.Context, namespace string) (string, error)
+}
+
+// k8sSecretProvider reads the token from a key of a Kubernetes secret in the
+// challenge namespace, caching the secret for ttl.
+type k8sSecretProvider struct {
+	client  kubernetes.Interface
+	secrets *secretCache
+	ref     corev1.SecretKeySelector
+	ttl     time.Duration
+}
+
+// tokenSecretKeys are tried in order when the reference names no key, as
+// different guides store the token under different keys.
+var tokenSecretKeys = []string{"token", "api-token", "apiKey"}
+
+// Token returns the value of the referenced key or, if the reference names
+// no key, of the first of tokenSecretKeys present in the secret.
+func (p k8sSecretProvider) Token(ctx context.Context, namespace string) (string, error) {
+	if p.ref.Key != "" {
+		return p.read(ctx, namespace, "token")
+	}
+	data, err := p.data(ctx, namespace, "token")
+	if err != nil {
+		return "", err
+	}
+	for _, key := range tokenSecretKeys {
+		if value, ok := data[key]; ok {
+			klog.V(2).Infof("using key %q of token secret %s/%s", key, namespace, p.ref.Name)
+			return string(value), nil
+		}
+	}
+	p.secrets.invalidate(secretCacheKey(namespace, p.ref.Name))
+	klog.Errorf("token secret %s/%s has none of the keys %q", namespace, p.ref.Name, tokenSecretKeys)
+	return "", fmt.Errorf("%w: secret `%s/%s` has none of the keys %q, set secretKeyRef.key", ErrSecretNotFound, namespace, p.ref.Name, tokenSecretKeys)
+}
+
+// read returns the value of the referenced key. kind names the credential in
+// log messages.
+func (p k8sSecretProvider) read(ctx context.Context, namespace, kind string) (string, error) {
+	ref := p.ref
+	if ref.Key == "" {
+		return "", ErrMissingSecretKeyRef
+	}
+	data, err := p.data(ctx, namespace, kind)
+	if err != nil {
+		return "", err
+	}
+
+	value, err := stringFromSecretData(data, ref.Key)
+	if err != nil {
+		p.secrets.invalidate(secretCacheKey(namespace, ref.Name))
+		klog.Errorf("%s secret %s/%s has no key %q", kind, namespace, ref.Name, ref.Key)
+		return "", err
+	}
+	return value, nil
+}
+
+// data returns the data of the referenced secret, from the cache if
+// possible.
+func (p k8sSecretProvider) data(ctx context.Context, namespace, kind string) (map[string][]byte, error) {
+	ref := p.ref
+	cacheKey := secretCacheKey(namespace, ref.Name)
+	data, ok := p.secrets.get(cacheKey)
+	if !ok {
+		sec, err := p.client.CoreV1().Secrets(namespace).Get(ctx, ref.Name, v1.GetOptions{})
+		if err != nil {
+			p.secrets.invalidate(cacheKey)
+			klog.Errorf("unable to read %s secret %s/%s: %v", kind, namespace, ref.Name, err)
+			switch {
+			case apierrors.IsNotFound(err):
+				return nil, fmt.Errorf("%w: secret `%s/%s` does not exist", ErrSecretNotFound, namespace, ref.Name)
+			case apierrors.IsForbidden(err):
+				return nil, fmt.Errorf("%w: reading secret `%s/%s` is forbidden; check the webhook ServiceAccount has get on secrets in namespace %s: %v",
+					ErrSecretForbidden, namespace, ref.Name, namespace, err)
+			}
+			return nil, fmt.Errorf("unable to get secret `%s/%s`; %w", namespace, ref.Name, err)
+		}
+		data = sec.Data
+		p.secrets.put(cacheKey, data, p.ttl)
+	}
+	return data, nil
+}
+
+// fileTokenProvider reads the token from a file, e.g. a mounted secret or a
+// projected service account volume.
+type fileTokenProvider struct {
+	path string
+}
+
+func (p fileTokenProvider) Token(context.Context, string) (string, error) {
+	return stringFromFile(p.path)
+}
+
+// credentialProvider selects the token source for the challenge from cfg.
+// The solver config arrives with every challenge, so the choice is made per
+// challenge, using the Kubernetes client set up in Initialize.
+func (c *domainOffensiveDNSProviderSolver) credentialProvider(ch *v1alpha1.ChallengeRequest, cfg domainOffensiveDNSProviderConfig) CredentialProvider {
+	ref, ok := tokenSecretRef(ch, cfg)
+	if !ok {
+		return fileTokenProvider{path: cfg.TokenFile}
+	}
+	return c.secretProvider(ref, cfg)
+}
+
+// secretProvider returns a provider for ref that shares the solver's secret
+// cache.
+func (c *domainOffensiveDNSProviderSolver) secretProvider(ref corev1.SecretKeySelector, cfg domainOffensiveDNSProviderConfig) k8sSecretProvider {
+	return k8sSecretProvider{client: c.client, secrets: c.secrets, ref: ref, ttl: cfg.SecretCacheTTL.Duration}
+}
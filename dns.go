@@ -0,0 +1,238 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/cert-manager/cert-manager/pkg/acme/webhook/apis/acme/v1alpha1"
+	"github.com/cert-manager/cert-manager/pkg/issuer/acme/dns/util"
+	"github.com/miekg/dns"
+	"k8s.io/klog/v2"
+)
+
+// maxCNAMEChain bounds how many CNAMEs are followed for a single name.
+const maxCNAMEChain = 10
+
+// followCNAME returns the final target of the CNAME chain starting at fqdn,
+// or fqdn itself if it has no CNAME record.
+func followCNAME(ctx context.Context, fqdn string, nameservers []string) (string, error) {
+	seen := map[string]bool{}
+	name := dns.Fqdn(fqdn)
+	for i := 0; i < maxCNAMEChain; i++ {
+		seen[name] = true
+
+		in, err := util.DNSQuery(ctx, name, dns.TypeCNAME, nameservers, true)
+		if err != nil {
+			return "", err
+		}
+		if in.Rcode != dns.RcodeSuccess {
+			return name, nil
+		}
+
+		var target string
+		for _, rr := range in.Answer {
+			if cn, ok := rr.(*dns.CNAME); ok && dns.CanonicalName(cn.Hdr.Name) == dns.CanonicalName(name) {
+				target = cn.Target
+				break
+			}
+		}
+		if target == "" {
+			return name, nil
+		}
+		if seen[target] {
+			return "", fmt.Errorf("CNAME loop detected at %q while resolving %q", target, fqdn)
+		}
+
+		klog.V(2).Infof("following CNAME %s -> %s", name, target)
+		name = target
+	}
+	return "", fmt.Errorf("CNAME chain for %q is longer than %d records", fqdn, maxCNAMEChain)
+}
+
+// findZone returns the zone fqdn belongs to, found by walking up the name
+// and querying nameservers for SOA records.
+func findZone(ctx context.Context, fqdn string, nameservers []string) (string, error) {
+	zone, err := util.FindZoneByFqdn(ctx, dns.Fqdn(fqdn), nameservers)
+	if err != nil {
+		return "", fmt.Errorf("%w for %s: %v", ErrZoneNotFound, fqdn, err)
+	}
+	return zone, nil
+}
+
+// isWildcardChallenge reports whether ch is for a wildcard name. Wildcard
+// and apex challenges share their FQDN: both *.example.com and example.com
+// are solved at _acme-challenge.example.com.
+func isWildcardChallenge(ch *v1alpha1.ChallengeRequest) bool {
+	return strings.HasPrefix(ch.DNSName, "*.")
+}
+
+// checkFQDNInZone verifies that fqdn is zone itself or a name below it. An
+// empty zone cannot be checked and is accepted.
+func checkFQDNInZone(fqdn, zone string) error {
+	if zone == "" {
+		return nil
+	}
+	if !dns.IsSubDomain(dns.CanonicalName(zone), dns.CanonicalName(fqdn)) {
+		return fmt.Errorf("%w: %s is not within zone %s", ErrFQDNOutsideZone, fqdn, zone)
+	}
+	return nil
+}
+
+// checkDomainAllowed verifies that fqdn is one of the allowlist suffixes or
+// a name below one. An empty allowlist allows every name.
+func checkDomainAllowed(fqdn string, allowlist []string) error {
+	if len(allowlist) == 0 || matchDomainSuffix(fqdn, allowlist) != "" {
+		return nil
+	}
+	return fmt.Errorf("%w: %s does not match any suffix of domainAllowlist %v", ErrDomainNotAllowed, fqdn, allowlist)
+}
+
+// checkDomainDenied verifies that fqdn is neither one of the denylist
+// suffixes nor a name below one.
+func checkDomainDenied(fqdn string, denylist []string) error {
+	if suffix := matchDomainSuffix(fqdn, denylist); suffix != "" {
+		return fmt.Errorf("%w: %s matches %s of domainDenylist", ErrDomainDenied, fqdn, suffix)
+	}
+	return nil
+}
+
+// matchDomainSuffix returns the first of suffixes that fqdn equals or is
+// below, comparing whole labels, or "" if none matches.
+func matchDomainSuffix(fqdn string, suffixes []string) string {
+	for _, suffix := range suffixes {
+		if dns.IsSubDomain(dns.CanonicalName(suffix), dns.CanonicalName(fqdn)) {
+			return suffix
+		}
+	}
+	return ""
+}
+
+// recordName returns the record name to send to the API for fqdn, either as
+// the normalized FQDN or, for recordNameRelative, relative to zone. The zone
+// apex is sent as "@".
+func recordName(fqdn, zone, format string) (string, error) {
+	name := normalizeDomain(fqdn)
+	if format != recordNameRelative {
+		return name, nil
+	}
+
+	zone = normalizeDomain(zone)
+	if zone == "" {
+		return "", fmt.Errorf("cannot make %s relative: challenge has no resolved zone", name)
+	}
+	if name == zone {
+		return "@", nil
+	}
+	relative, ok := strings.CutSuffix(name, "."+zone)
+	if !ok {
+		return "", fmt.Errorf("cannot make %s relative: not within zone %s", name, zone)
+	}
+	return relative, nil
+}
+
+// recordFQDN returns the normalized FQDN of the record the API manages as
+// name, the reverse of recordName.
+func recordFQDN(name, zone, format string) string {
+	if format != recordNameRelative {
+		return normalizeDomain(name)
+	}
+	zone = normalizeDomain(zone)
+	if name == "@" {
+		return zone
+	}
+	return normalizeDomain(name) + "." + zone
+}
+
+// challengeLabel is the leading label of every dns-01 challenge name.
+const challengeLabel = "_acme-challenge"
+
+// isDNSLabel reports whether s is a single syntactically valid DNS label.
+func isDNSLabel(s string) bool {
+	n, ok := dns.IsDomainName(s)
+	return ok && n == 1 && !strings.HasSuffix(s, ".")
+}
+
+// isDNSName reports whether s is a syntactically valid domain name of at
+// least one label, with or without trailing dot.
+func isDNSName(s string) bool {
+	n, ok := dns.IsDomainName(s)
+	return ok && n > 0
+}
+
+// replaceChallengeLabel replaces the leading _acme-challenge label of the
+// record name with prefix. Names without that label, and any name if prefix
+// is empty, are returned unchanged.
+func replaceChallengeLabel(name, prefix string) (string, error) {
+	if prefix == "" {
+		return name, nil
+	}
+	rest, ok := strings.CutPrefix(name, challengeLabel)
+	if !ok || (rest != "" && rest[0] != '.') {
+		return name, nil
+	}
+	name = strings.ToLower(prefix) + rest
+	if _, ok := dns.IsDomainName(name); !ok {
+		return "", fmt.Errorf("record name %q with prefix %q is not a valid DNS name", name, prefix)
+	}
+	return name, nil
+}
+
+// lookupTXT returns the TXT values served for fqdn by nameservers, or by the
+// authoritative nameservers of its zone, discovered through resolvers, if
+// none are given.
+func lookupTXT(ctx context.Context, fqdn string, nameservers, resolvers []string) ([]string, error) {
+	fqdn = dns.Fqdn(fqdn)
+	if len(nameservers) == 0 {
+		var err error
+		nameservers, err = authoritativeNameservers(ctx, fqdn, resolvers)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	in, err := util.DNSQuery(ctx, fqdn, dns.TypeTXT, nameservers, false)
+	if err != nil {
+		return nil, err
+	}
+	switch in.Rcode {
+	case dns.RcodeSuccess:
+	case dns.RcodeNameError:
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("TXT lookup for %s returned %s", fqdn, dns.RcodeToString[in.Rcode])
+	}
+
+	var values []string
+	for _, rr := range in.Answer {
+		if txt, ok := rr.(*dns.TXT); ok {
+			values = append(values, strings.Join(txt.Txt, ""))
+		}
+	}
+	return values, nil
+}
+
+// authoritativeNameservers returns the addresses of the nameservers of the
+// zone fqdn belongs to, as looked up through resolvers.
+func authoritativeNameservers(ctx context.Context, fqdn string, resolvers []string) ([]string, error) {
+	zone, err := util.FindZoneByFqdn(ctx, fqdn, resolvers)
+	if err != nil {
+		return nil, err
+	}
+	in, err := util.DNSQuery(ctx, zone, dns.TypeNS, resolvers, true)
+	if err != nil {
+		return nil, err
+	}
+
+	var nameservers []string
+	for _, rr := range in.Answer {
+		if ns, ok := rr.(*dns.NS); ok {
+			nameservers = append(nameservers, net.JoinHostPort(ns.Ns, "53"))
+		}
+	}
+	if len(nameservers) == 0 {
+		return nil, fmt.Errorf("no nameservers found for zone %s", zone)
+	}
+	return nameservers, nil
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+
+	"github.com/cert-manager/cert-manager/pkg/acme/webhook/apis/acme/v1alpha1"
+	"k8s.io/klog/v2"
+)
+
+// doAPIClient sends TXT record changes to the letsencrypt endpoint of the
+// do.de API. It builds the request parameters, authenticates with the token
+// as configured by authMode, retries transient failures and parses the
+// response. Record names and values are sent as given; mapping a challenge
+// to them is up to the caller, see callDoApi.
+type doAPIClient struct {
+	httpClient *http.Client
+	baseURL    string
+	// fallbacks are tried in order when baseURL fails with a connection
+	// error or a 5xx status.
+	fallbacks []string
+	token     string
+	// cfg holds the request options: httpMethod, authMode, paramNames,
+	// recordType, recordTTL, the actions, headers, timeouts and retries.
+	cfg domainOffensiveDNSProviderConfig
+	// ch, if set, is the challenge named in logs.
+	ch *v1alpha1.ChallengeRequest
+
+	// endpoint is the endpoint that answered the last request.
+	endpoint string
+}
+
+// newDoAPIClient returns a client sending requests through httpClient to
+// baseURL, then fallbacks, with the options of cfg and the given token. ch
+// may be nil.
+func newDoAPIClient(httpClient *http.Client, baseURL string, fallbacks []string, token string, cfg domainOffensiveDNSProviderConfig, ch *v1alpha1.ChallengeRequest) *doAPIClient {
+	return &doAPIClient{httpClient: httpClient, baseURL: baseURL, fallbacks: slices.Clone(fallbacks), token: token, cfg: cfg, ch: ch}
+}
+
+// PresentTXT adds value to the TXT record set at domain and returns the ID
+// of the created record, if the API reports one.
+func (c *doAPIClient) PresentTXT(ctx context.Context, domain, value string) (string, error) {
+	q := url.Values{"value": {value}}
+	if c.cfg.PresentAction != "" {
+		q.Set("action", c.cfg.PresentAction)
+	}
+	if c.cfg.RecordTTL > 0 {
+		q.Set("ttl", strconv.Itoa(c.cfg.RecordTTL))
+	}
+	return c.do(ctx, operationPresent, domain, q)
+}
+
+// DeleteTXT removes value from the TXT record set at domain, leaving other
+// values alone.
+func (c *doAPIClient) DeleteTXT(ctx context.Context, domain, value string) error {
+	_, err := c.do(ctx, operationCleanup, domain, url.Values{"value": {value}, "action": {c.cfg.DeleteAction}})
+	return err
+}
+
+// DeleteTXTByID removes the record with the given ID from the TXT record set
+// at domain. The value is sent along, as the endpoint clears every value at
+// the name on a delete without one if it ignores record_id.
+func (c *doAPIClient) DeleteTXTByID(ctx context.Context, domain, id, value string) error {
+	_, err := c.do(ctx, operationCleanup, domain, url.Values{"record_id": {id}, "value": {value}, "action": {c.cfg.DeleteAction}})
+	return err
+}
+
+// ClearTXT removes every value from the TXT record set at domain by sending
+// the delete action without a value.
+func (c *doAPIClient) ClearTXT(ctx context.Context, domain string) error {
+	_, err := c.do(ctx, operationCleanup, domain, url.Values{"action": {c.cfg.DeleteAction}})
+	return err
+}
+
+// do sends q along with the domain, record type and credentials, and returns
+// the record ID of a successful response.
+func (c *doAPIClient) do(ctx context.Context, operation, domain string, q url.Values) (string, error) {
+	ch := c.ch
+	if ch == nil {
+		ch = &v1alpha1.ChallengeRequest{ResolvedFQDN: domain}
+	}
+	header := apiHeader(c.cfg, c.token, q)
+	q.Set("domain", domain)
+	q.Set("type", c.cfg.RecordType)
+	klog.V(2).InfoS("mapped challenge to api parameters", requestMapping(operation, ch, q)...)
+	q = renameParams(q, c.cfg.ParamNames)
+
+	r := apiRequest{
+		method: c.cfg.HTTPMethod,
+		params: q,
+		header: header,
+		token:  c.token,
+
+		secretURL:   secretURL(c.cfg),
+		maxBodySize: c.cfg.MaxResponseBodySize,
+	}
+	if c.cfg.DryRun {
+		r.url = c.baseURL
+		klog.Infof("dry run: not sending %s request for %v: %v", operation, ch.ResolvedFQDN, r)
+		return "", nil
+	}
+
+	endpoints := append([]string{c.baseURL}, c.fallbacks...)
+	resp, endpoint, err := sendWithRetries(ctx, c.httpClient, ch, c.cfg, r, endpoints, operation)
+	c.endpoint = endpoint
+	if err != nil {
+		return "", err
+	}
+
+	statusOK := resp.statusCode == http.StatusOK
+	if c.cfg.SuccessStatusOnly {
+		statusOK = resp.statusCode >= 200 && resp.statusCode < 300
+	}
+	if !statusOK {
+		return "", fmt.Errorf("%w: api status %d: %s", ErrAPIFailure, resp.statusCode, string(resp.body))
+	}
+	if c.cfg.SuccessStatusOnly {
+		return "", nil
+	}
+	result, err := parseAPIResponse(resp.body)
+	if err != nil {
+		return "", err
+	}
+	if !result.known {
+		if err := handleMissingSuccess(ch, c.cfg, resp, c.token); err != nil {
+			return "", err
+		}
+	}
+	return result.recordID, nil
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+)
+
+// validateEnvironment checks the environment variables the webhook reads at
+// startup and reports every problem found at once.
+func validateEnvironment() error {
+	var errs []error
+	if os.Getenv("GROUP_NAME") == "" {
+		errs = append(errs, errors.New("GROUP_NAME must be specified"))
+	}
+	for _, name := range []string{"METRICS_PORT", "STATUS_PORT"} {
+		if v := os.Getenv(name); v != "" {
+			if port, err := strconv.Atoi(v); err != nil || port < 1 || port > 65535 {
+				errs = append(errs, fmt.Errorf("%s must be a port number, got %q", name, v))
+			}
+		}
+	}
+	switch v := os.Getenv("LOG_FORMAT"); v {
+	case "", logFormatText, logFormatJSON:
+	default:
+		errs = append(errs, fmt.Errorf("LOG_FORMAT must be %q or %q, got %q", logFormatText, logFormatJSON, v))
+	}
+	if v := os.Getenv("LOG_LEVEL"); v != "" {
+		if _, err := parseLogLevel(v); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if _, err := newAPIHealthCheckerFromEnv(); err != nil {
+		errs = append(errs, err)
+	}
+	if _, err := newRateLimiterFromEnv(); err != nil {
+		errs = append(errs, err)
+	}
+	if _, err := newRequestSemaphoreFromEnv(); err != nil {
+		errs = append(errs, err)
+	}
+	if _, err := newCircuitBreakersFromEnv(); err != nil {
+		errs = append(errs, err)
+	}
+	if _, err := newStateLimitsFromEnv(); err != nil {
+		errs = append(errs, err)
+	}
+	if _, err := newReconcilerFromEnv(); err != nil {
+		errs = append(errs, err)
+	}
+	if _, err := shutdownCleanupFromEnv(); err != nil {
+		errs = append(errs, err)
+	}
+	if _, err := selfTestFromEnv(); err != nil {
+		errs = append(errs, err)
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,50 @@
+package main
+
+import "errors"
+
+// Sentinel errors returned, possibly wrapped, by Present and CleanUp, so
+// callers can tell permanent configuration problems from API failures that
+// may succeed on retry. Match them with errors.Is.
+var (
+	// ErrMissingSecretKeyRef means the config does not name a usable token
+	// source.
+	ErrMissingSecretKeyRef = errors.New("missing SecretKeyRef")
+	// ErrSecretNotFound means the referenced token secret, or the key in
+	// it, does not exist.
+	ErrSecretNotFound = errors.New("token secret not found")
+	// ErrSecretForbidden means the webhook is not allowed to read the
+	// referenced secret, usually because of missing RBAC permissions.
+	ErrSecretForbidden = errors.New("access to token secret forbidden")
+	// ErrEmptyChallengeKey means the challenge request carries no key, which
+	// points at a bug in the caller.
+	ErrEmptyChallengeKey = errors.New("challenge key is empty")
+	// ErrFQDNOutsideZone means the challenge FQDN does not belong to the
+	// zone it was resolved to, which usually points at a misrouted
+	// challenge.
+	ErrFQDNOutsideZone = errors.New("challenge fqdn outside of zone")
+	// ErrDomainNotAllowed means the challenge FQDN is outside the
+	// configured domainAllowlist.
+	ErrDomainNotAllowed = errors.New("domain not allowed")
+	// ErrDomainDenied means the challenge FQDN matches the configured
+	// domainDenylist.
+	ErrDomainDenied = errors.New("domain denied")
+	// ErrZoneNotFound means the challenge came without a resolved zone and
+	// no zone could be discovered for its FQDN through SOA lookups.
+	ErrZoneNotFound = errors.New("no authoritative zone found")
+	// ErrRecordNotDeleted means the API accepted the delete request but the
+	// nameservers kept serving the challenge value.
+	ErrRecordNotDeleted = errors.New("record still served after delete")
+	// ErrCircuitOpen means the request was not sent because the API host
+	// failed repeatedly and its circuit breaker is open.
+	ErrCircuitOpen = errors.New("api circuit breaker open")
+	// ErrInvalidToken means the API rejected the token itself. It is
+	// matched along with ErrAPIFailure.
+	ErrInvalidToken = errors.New("api token invalid")
+	// ErrDomainNotManaged means the API accepted the token but it may not
+	// manage the challenge domain, which usually points at the wrong secret
+	// being attached to the issuer. It is matched along with ErrAPIFailure.
+	ErrDomainNotManaged = errors.New("domain not managed by api token")
+	// ErrAPIFailure means the do.de API could not be reached or did not
+	// accept the request.
+	ErrAPIFailure = errors.New("api request failed")
+)
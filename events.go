@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/klog/v2"
+
+	"github.com/cert-manager/cert-manager/pkg/acme/webhook/apis/acme/v1alpha1"
+)
+
+// Event reasons recorded by the solver.
+const (
+	reasonPresentFailed = "PresentFailed"
+	reasonCleanUpFailed = "CleanUpFailed"
+)
+
+// challengeLookupTimeout bounds the search for the Challenge an event is
+// recorded against.
+const challengeLookupTimeout = 5 * time.Second
+
+// newEventRecorder returns a recorder that writes events through cl, along
+// with the broadcaster that has to be shut down once the solver stops.
+func newEventRecorder(cl kubernetes.Interface) (record.EventRecorder, record.EventBroadcaster) {
+	b := record.NewBroadcaster()
+	b.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: cl.CoreV1().Events("")})
+	return b.NewRecorder(scheme.Scheme, corev1.EventSource{Component: "domain-offensive-webhook"}), b
+}
+
+// recordFailure emits a warning event describing err. The event is attached
+// to the Challenge the request belongs to, or to the challenge namespace if
+// the Challenge cannot be found.
+func (c *domainOffensiveDNSProviderSolver) recordFailure(ch *v1alpha1.ChallengeRequest, reason string, err error) {
+	if c.recorder == nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(c.baseContext(), challengeLookupTimeout)
+	defer cancel()
+
+	c.recorder.Eventf(c.challengeReference(ctx, ch), corev1.EventTypeWarning, reason, "%v", err)
+}
+
+// challengeReference finds the Challenge resource matching the request.
+func (c *domainOffensiveDNSProviderSolver) challengeReference(ctx context.Context, ch *v1alpha1.ChallengeRequest) *corev1.ObjectReference {
+	ref := &corev1.ObjectReference{
+		APIVersion: "v1",
+		Kind:       "Namespace",
+		Name:       ch.ResourceNamespace,
+		Namespace:  ch.ResourceNamespace,
+	}
+	if c.cmClient == nil {
+		return ref
+	}
+
+	list, err := c.cmClient.AcmeV1().Challenges(ch.ResourceNamespace).List(ctx, v1.ListOptions{})
+	if err != nil {
+		klog.V(4).Infof("unable to list challenges in namespace %s: %v", ch.ResourceNamespace, err)
+		return ref
+	}
+	for _, chal := range list.Items {
+		if chal.Spec.Key == ch.Key && chal.Spec.DNSName == ch.DNSName {
+			return &corev1.ObjectReference{
+				APIVersion: "acme.cert-manager.io/v1",
+				Kind:       "Challenge",
+				Name:       chal.Name,
+				Namespace:  chal.Namespace,
+				UID:        chal.UID,
+			}
+		}
+	}
+	return ref
+}
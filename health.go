@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"k8s.io/klog/v2"
+)
+
+const (
+	defaultHealthCheckInterval = 30 * time.Second
+	healthCheckTimeout         = 10 * time.Second
+)
+
+// apiHealthChecker periodically verifies that the API endpoint accepts
+// connections and answers HTTP requests. It does not authenticate, so any
+// HTTP response counts as reachable.
+type apiHealthChecker struct {
+	interval time.Duration
+
+	mu     sync.RWMutex
+	apiURL string
+	// client is the API client of the config apiURL was taken from, so the
+	// probe honors its proxy, CA bundle and IP family.
+	client *http.Client
+	// fromSecret hides apiURL in logs and the status output, as it was read
+	// from apiUrlSecretKeyRef.
+	fromSecret bool
+	err        error
+}
+
+func newAPIHealthChecker(interval time.Duration) *apiHealthChecker {
+	return &apiHealthChecker{
+		interval: interval,
+		client:   &http.Client{},
+		apiURL:   defaultApiURL,
+		err:      errors.New("api reachability not checked yet"),
+	}
+}
+
+// setURL changes the endpoint that is checked, typically to the apiUrl of the
+// most recently loaded solver config, along with the client to reach it.
+// An endpoint fromSecret is only shown redacted.
+func (h *apiHealthChecker) setURL(apiURL string, client *http.Client, fromSecret bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.apiURL = apiURL
+	h.client = client
+	h.fromSecret = fromSecret
+}
+
+// shownURL returns apiURL as it may appear in logs and the status output.
+func shownURL(apiURL string, fromSecret bool) string {
+	if fromSecret {
+		return redactedPlaceholder
+	}
+	return apiURL
+}
+
+// run checks the endpoint every interval until ctx is cancelled.
+func (h *apiHealthChecker) run(ctx context.Context) {
+	for {
+		h.check(ctx)
+		if err := sleepContext(ctx, h.interval); err != nil {
+			return
+		}
+	}
+}
+
+func (h *apiHealthChecker) check(ctx context.Context) {
+	h.mu.RLock()
+	apiURL, client, fromSecret := h.apiURL, h.client, h.fromSecret
+	h.mu.RUnlock()
+
+	if fromSecret {
+		ctx = withSecretHost(ctx)
+	}
+	err := h.probe(ctx, client, apiURL)
+	if fromSecret {
+		err = redactSecretURLError(err, apiURL)
+	}
+	if err != nil {
+		klog.Warningf("api endpoint %s is unreachable: %v", shownURL(apiURL, fromSecret), err)
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.err = err
+}
+
+// probe sends a HEAD request to apiURL, giving up after healthCheckTimeout.
+func (h *apiHealthChecker) probe(ctx context.Context, client *http.Client, apiURL string) error {
+	ctx, cancel := context.WithTimeout(ctx, healthCheckTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, apiURL, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("User-Agent", defaultUserAgent())
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// ServeHTTP reports 200 if the last check reached the API and 503 otherwise.
+func (h *apiHealthChecker) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	h.mu.RLock()
+	apiURL, err := shownURL(h.apiURL, h.fromSecret), h.err
+	h.mu.RUnlock()
+
+	if err != nil {
+		http.Error(w, fmt.Sprintf("api endpoint %s unreachable: %v", apiURL, err), http.StatusServiceUnavailable)
+		return
+	}
+	fmt.Fprintf(w, "api endpoint %s reachable\n", apiURL)
+}
+
+// newAPIHealthCheckerFromEnv returns a checker that runs every
+// HEALTH_CHECK_INTERVAL, or every 30s if it is not set.
+func newAPIHealthCheckerFromEnv() (*apiHealthChecker, error) {
+	interval := defaultHealthCheckInterval
+	if v := os.Getenv("HEALTH_CHECK_INTERVAL"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid HEALTH_CHECK_INTERVAL %q: %v", v, err)
+		}
+		if d <= 0 {
+			return nil, fmt.Errorf("HEALTH_CHECK_INTERVAL must be positive, got %v", d)
+		}
+		interval = d
+	}
+	return newAPIHealthChecker(interval), nil
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cert-manager/cert-manager/pkg/acme/webhook/apis/acme/v1alpha1"
+	"k8s.io/klog/v2"
+)
+
+// Supported values of the LOG_FORMAT environment variable. It only affects
+// the operation logs written through logEvent; everything else is logged by
+// klog as text.
+const (
+	logFormatText = "text"
+	logFormatJSON = "json"
+)
+
+// logLevels maps the names accepted in LOG_LEVEL to klog verbosity. debug adds
+// the mapping of challenges to API parameters, trace the (redacted) API
+// requests and responses.
+var logLevels = map[string]klog.Level{
+	"info":  0,
+	"debug": 2,
+	"trace": 4,
+}
+
+// parseLogLevel parses a LOG_LEVEL value, either a level name or a
+// non-negative klog verbosity.
+func parseLogLevel(v string) (klog.Level, error) {
+	if level, ok := logLevels[strings.ToLower(v)]; ok {
+		return level, nil
+	}
+	if n, err := strconv.Atoi(v); err == nil && n >= 0 {
+		return klog.Level(n), nil
+	}
+	return 0, fmt.Errorf("LOG_LEVEL must be info, debug, trace or a non-negative number, got %q", v)
+}
+
+// logLevelArgs returns the webhook command line args with --v set from
+// LOG_LEVEL. Setting klog's verbosity directly would not last, as the webhook
+// command applies its logging options, verbosity included, once it has
+// validated them. Args are returned unchanged if LOG_LEVEL is unset or they
+// set -v already, which takes precedence.
+func logLevelArgs(args []string) ([]string, error) {
+	v := os.Getenv("LOG_LEVEL")
+	if v == "" {
+		return args, nil
+	}
+	level, err := parseLogLevel(v)
+	if err != nil {
+		return nil, err
+	}
+	for _, arg := range args {
+		if arg == "--" {
+			break
+		}
+		if setsVerbosity(arg) {
+			return args, nil
+		}
+	}
+	return slices.Concat(args, []string{"--v=" + strconv.Itoa(int(level))}), nil
+}
+
+// setsVerbosity reports whether arg is the -v flag, given as --v, --v=N, -v,
+// -vN or -v=N.
+func setsVerbosity(arg string) bool {
+	if long, ok := strings.CutPrefix(arg, "--"); ok {
+		name, _, _ := strings.Cut(long, "=")
+		return name == "v"
+	}
+	return strings.HasPrefix(arg, "-v")
+}
+
+// Status values of operation logs, and results of operationsTotal, beyond
+// those of the API calls.
+const (
+	statusConfigError      = "config_error"
+	statusPropagationError = "propagation_error"
+)
+
+var (
+	logMu     sync.Mutex
+	logOutput io.Writer = os.Stderr
+	logJSON             = os.Getenv("LOG_FORMAT") == logFormatJSON
+)
+
+// operationEvent describes the outcome of a present or cleanup operation, or
+// of a single API call made for one.
+type operationEvent struct {
+	Message   string
+	Operation string
+	Challenge *v1alpha1.ChallengeRequest
+	// Endpoint is the API endpoint that answered, if any.
+	Endpoint string
+	Status   string
+	Start    time.Time
+	Err      error
+	// Warning logs an event without error at warning level.
+	Warning bool
+}
+
+// logEvent writes e to the operation log, as JSON if LOG_FORMAT=json and
+// through klog otherwise. Field names are the same in both formats.
+func logEvent(e operationEvent) {
+	fields := []any{
+		"operation", e.Operation,
+		"fqdn", e.Challenge.ResolvedFQDN,
+		"zone", e.Challenge.ResolvedZone,
+		"namespace", e.Challenge.ResourceNamespace,
+		"status", e.Status,
+		"duration_ms", time.Since(e.Start).Milliseconds(),
+	}
+	if e.Endpoint != "" {
+		fields = append(fields, "endpoint", e.Endpoint)
+	}
+
+	if !logJSON {
+		switch {
+		case e.Err != nil:
+			klog.ErrorSDepth(1, e.Err, e.Message, fields...)
+		case e.Warning:
+			// klog has no structured warning call
+			klog.WarningDepth(1, formatFields(e.Message, fields))
+		default:
+			klog.InfoSDepth(1, e.Message, fields...)
+		}
+		return
+	}
+
+	entry := map[string]any{
+		"ts":    time.Now().UTC().Format(time.RFC3339Nano),
+		"level": "info",
+		"msg":   e.Message,
+	}
+	for i := 0; i < len(fields); i += 2 {
+		entry[fields[i].(string)] = fields[i+1]
+	}
+	if e.Warning {
+		entry["level"] = "warning"
+	}
+	if e.Err != nil {
+		entry["level"] = "error"
+		entry["error"] = e.Err.Error()
+	}
+	line, err := json.Marshal(entry)
+	if err != nil {
+		klog.Errorf("unable to encode log entry %q: %v", e.Message, err)
+		return
+	}
+
+	logMu.Lock()
+	defer logMu.Unlock()
+	fmt.Fprintf(logOutput, "%s\n", line)
+}
+
+// formatFields renders msg and key/value pairs the way klog.InfoS does.
+func formatFields(msg string, fields []any) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%q", msg)
+	for i := 0; i < len(fields); i += 2 {
+		if v, ok := fields[i+1].(string); ok {
+			fmt.Fprintf(&b, " %s=%q", fields[i], v)
+		} else {
+			fmt.Fprintf(&b, " %s=%v", fields[i], fields[i+1])
+		}
+	}
+	return b.String()
+}
@@ -1,200 +1,2339 @@
 package main
 
 import (
+	"bytes"
+	"compress/gzip"
 	"context"
+	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"math/rand/v2"
 	"net/http"
 	"net/url"
 	"os"
+	"slices"
+	"strconv"
 	"strings"
+	"text/template"
+	"time"
 
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
 	corev1 "k8s.io/api/core/v1"
 	extapi "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
-	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/record"
 	"k8s.io/klog/v2"
 
 	"github.com/cert-manager/cert-manager/pkg/acme/webhook/apis/acme/v1alpha1"
 	"github.com/cert-manager/cert-manager/pkg/acme/webhook/cmd"
+	cmclient "github.com/cert-manager/cert-manager/pkg/client/clientset/versioned"
+	"github.com/cert-manager/cert-manager/pkg/issuer/acme/dns/util"
 )
 
 var GroupName = os.Getenv("GROUP_NAME")
 
+const (
+	defaultApiURL      = "https://my.do.de/api/letsencrypt"
+	defaultHTTPTimeout = 30 * time.Second
+
+	defaultSlowCallThreshold = 5 * time.Second
+
+	defaultRetryMaxAttempts = 3
+	maxRetryAttempts        = 10
+	defaultRetryBaseDelay   = 1 * time.Second
+	defaultRetryAfterMax    = 60 * time.Second
+
+	// The API is a single host, so keep more idle connections to it than
+	// http.DefaultTransport does to absorb renewal bursts.
+	defaultMaxIdleConns        = 20
+	defaultMaxIdleConnsPerHost = 10
+	defaultIdleConnTimeout     = 90 * time.Second
+
+	defaultPropagationTimeout    = 2 * time.Minute
+	defaultVerifyDeletionTimeout = time.Minute
+	defaultSecretCacheTTL        = 30 * time.Second
+
+	// shutdownCleanupTimeout bounds the cleanup of outstanding records when
+	// the webhook stops, well within the default termination grace period.
+	shutdownCleanupTimeout = 10 * time.Second
+
+	// defaultMaxResponseBodySize is far above any real API response.
+	defaultMaxResponseBodySize = 1 << 20
+
+	// maxRecordTTL is one day; challenge records are short lived.
+	maxRecordTTL = 86400
+)
+
+// defaultDeleteAction is the action parameter the API expects for deletes.
+const defaultDeleteAction = "delete"
+
+// testTrafficHeader marks requests sent in test mode.
+const testTrafficHeader = "X-Test-Traffic"
+
+// defaultUserAgent identifies the webhook to the API.
+func defaultUserAgent() string {
+	return "cert-manager-webhook-domain-offensive/" + version
+}
+
+// supportedRecordTypes are the accepted values of the recordType config
+// field. ACME DNS01 challenges are only ever solved with TXT records.
+var supportedRecordTypes = []string{"TXT"}
+
+// Supported values for the recordNameFormat config field.
+const (
+	recordNameFQDN     = "fqdn"
+	recordNameRelative = "relative"
+)
+
+// Supported values for the tokenEncoding config field.
+const (
+	tokenEncodingRaw    = "raw"
+	tokenEncodingBase64 = "base64"
+)
+
+// Supported values for the valueEncoding config field.
+const (
+	valueEncodingRaw    = "raw"
+	valueEncodingQuoted = "quoted"
+	valueEncodingBase64 = "base64"
+)
+
+// Supported values for the ipFamily config field.
+const (
+	ipFamilyAuto = "auto"
+	ipFamilyIPv4 = "ipv4"
+	ipFamilyIPv6 = "ipv6"
+)
+
+// Supported values for the missingSuccess config field.
+const (
+	missingSuccessStrict  = "strict"
+	missingSuccessLenient = "lenient"
+	missingSuccessWarn    = "warn"
+)
+
+// Supported values for the authMode config field.
+const (
+	authModeQuery  = "query"
+	authModeHeader = "header"
+)
+
 func main() {
-	if GroupName == "" {
-		panic("GROUP_NAME must be specified")
+	logBuildInfo()
+	if err := validateEnvironment(); err != nil {
+		klog.Fatalf("invalid environment:\n%v", err)
 	}
+	args, err := logLevelArgs(os.Args[1:])
+	if err != nil {
+		klog.Fatalf("unable to set log level: %v", err)
+	}
+	os.Args = append(os.Args[:1], args...)
 
-	cmd.RunWebhookServer(GroupName,
-		&domainOffensiveDNSProviderSolver{},
-	)
+	go serveMetrics()
+
+	shutdownTracing, err := setupTracing(context.Background())
+	if err != nil {
+		klog.Fatalf("unable to set up tracing: %v", err)
+	}
+
+	solver := &domainOffensiveDNSProviderSolver{}
+	cmd.RunWebhookServer(GroupName, solver)
+	solver.waitForShutdown()
+
+	if err := shutdownTracing(context.Background()); err != nil {
+		klog.Errorf("unable to flush traces: %v", err)
+	}
 }
 
+// domainOffensiveDNSProviderSolver solves DNS01 challenges through the do.de
+// API. cert-manager calls Present and CleanUp concurrently on a single
+// instance, e.g. for the names of a SAN certificate. All fields are set once
+// in Initialize and only read afterwards; any state that is mutated while
+// challenges are solved must guard itself, as secretCache and
+// apiHealthChecker do.
 type domainOffensiveDNSProviderSolver struct {
-	client *kubernetes.Clientset
+	client kubernetes.Interface
+	// cmClient is used to find the Challenge that failure events are
+	// recorded against.
+	cmClient cmclient.Interface
+	recorder record.EventRecorder
+	// secrets caches token secrets for a short time.
+	secrets *secretCache
+	// httpClient, if set, is used for all API requests instead of the
+	// clients built from the transport settings of each config. Per-request
+	// timeouts are applied through the request context.
+	httpClient *http.Client
+	clients    *clientCache
+	// health checks API reachability; nil unless STATUS_PORT is set.
+	health *apiHealthChecker
+	// configs holds the effective configs exposed on /config.
+	configs *configStore
+	// active holds the keys of challenges in progress, which orphan
+	// cleanup must not remove.
+	active *activeKeys
+	// recordIDs holds the presented records awaiting cleanup, with their
+	// IDs.
+	recordIDs *recordIDStore
+	// reconciler removes stale records periodically; nil unless
+	// RECONCILE_INTERVAL is set.
+	reconciler *reconciler
+	// nameservers are the recursive nameservers used to discover a missing
+	// zone. util.RecursiveNameservers are used if empty.
+	nameservers []string
+	// ctx is cancelled when the webhook server stops, aborting any
+	// in-flight secret lookups and API requests.
+	ctx context.Context
+	// shutdownDone is closed once outstanding records were cleaned up
+	// after the webhook server stopped.
+	shutdownDone chan struct{}
 }
 
 type domainOffensiveDNSProviderConfig struct {
-	ApiURL string `json:"apiUrl"`
+	// ApiMode selects the API the records are managed through:
+	// "letsencrypt" (default), the shortcut endpoint for ACME challenges, or
+	// "records", the general record management API, which takes a TTL and
+	// deletes records by ID. httpMethod, presentAction, deleteAction and
+	// apiPathTemplate only apply to the shortcut endpoint.
+	ApiMode string `json:"apiMode"`
+	// ApiURL is the API endpoint, or a list of endpoints that are tried in
+	// order when one fails with a connection error or a 5xx status. In
+	// records mode it is the base the zone paths are appended to. Defaults
+	// to the endpoint of the apiMode.
+	ApiURL endpointList `json:"apiUrl"`
+	// SecretKeyRef references the API token. Without a key, the keys
+	// token, api-token and apiKey are tried in that order.
 	SecretKeyRef corev1.SecretKeySelector `json:"secretKeyRef"`
+	// ApiURLSecretKeyRef references a secret holding the API endpoint, for
+	// endpoints that should not appear in the issuer. It takes precedence
+	// over apiUrl, and is shown as *** in logs, errors and /healthz.
+	ApiURLSecretKeyRef *corev1.SecretKeySelector `json:"apiUrlSecretKeyRef,omitempty"`
+	// ApiPathTemplate is a Go text/template whose output is appended to the
+	// path of each apiUrl, for reverse proxies that expect e.g. the zone in
+	// the path: "/zones/{{.Zone}}". The variables .Zone, .FQDN and .Name
+	// hold the resolved zone, the record FQDN and the record name sent to
+	// the API, all without trailing dot. Empty, the default, uses apiUrl as
+	// is.
+	ApiPathTemplate string `json:"apiPathTemplate"`
+	// HTTPTimeout bounds a single API request, including reading the
+	// response body. Defaults to 30s.
+	HTTPTimeout duration `json:"httpTimeout"`
+	// CleanupTimeout bounds all of CleanUp, including retries, so a slow
+	// API cannot delay shutdown. Defaults to httpTimeout.
+	CleanupTimeout duration `json:"cleanupTimeout"`
+	// SlowCallThreshold makes a single attempt of an API call that takes
+	// longer than this log a warning. Retries and the backoff between them
+	// are not counted. Defaults to 5s.
+	SlowCallThreshold duration `json:"slowCallThreshold"`
+	// RetryMaxAttempts caps how often a request is attempted when it fails
+	// with a network error or a transient HTTP status. Defaults to 3.
+	RetryMaxAttempts int `json:"retryMaxAttempts"`
+	// RetryBaseDelay is the initial backoff between attempts. Defaults to
+	// 1s.
+	RetryBaseDelay duration `json:"retryBaseDelay"`
+	// BackoffStrategy is how the backoff grows with every further attempt:
+	// "fixed" keeps retryBaseDelay, "linear" adds it and "exponential"
+	// (default) doubles it, with jitter.
+	BackoffStrategy string `json:"backoffStrategy"`
+	// RetryAfterMax caps the wait honored from a Retry-After header on a
+	// 429 response. Defaults to 60s.
+	RetryAfterMax duration `json:"retryAfterMax"`
+	// WaitForPropagation makes Present block until the TXT record is served
+	// by all authoritative nameservers of the zone, with the value and at
+	// the name it was sent with.
+	WaitForPropagation bool `json:"waitForPropagation"`
+	// PropagationTimeout bounds the propagation check. Defaults to 2m.
+	PropagationTimeout duration `json:"propagationTimeout"`
+	// PresentDelay makes Present wait this long after the record was
+	// created, before any propagation check, for zones that are slow to
+	// serve new records. Zero, the default, returns right away.
+	PresentDelay duration `json:"presentDelay"`
+	// PresentJitter makes Present wait a random time up to this long before
+	// its first API request, so challenges that start together, e.g. after
+	// a cluster restart, spread their requests. Zero, the default, disables
+	// the jitter.
+	PresentJitter duration `json:"presentJitter"`
+	// PropagationNameservers are queried directly by the propagation check,
+	// as host or host:port. If empty, the zone's authoritative nameservers
+	// are discovered through its SOA record.
+	PropagationNameservers []string `json:"propagationNameservers"`
+	// DNSResolvers are the recursive resolvers, as host or host:port, used
+	// to discover zones and their authoritative nameservers and to follow
+	// CNAMEs, e.g. for split-horizon setups. Defaults to the resolvers of
+	// the webhook pod.
+	DNSResolvers []string `json:"dnsResolvers"`
+	// AccountIDSecretKeyRef references an account ID that is sent as the
+	// account_id parameter along with the token, for API endpoints that
+	// require both. Optional; the token alone is sent when unset.
+	AccountIDSecretKeyRef *corev1.SecretKeySelector `json:"accountIdSecretKeyRef,omitempty"`
+	// TokenFile is the path to a file holding the API token. It is an
+	// alternative to SecretKeyRef; setting both is an error.
+	TokenFile string `json:"tokenFile"`
+	// TokenEncoding is how the token is stored: "raw" (default) or
+	// "base64", for tokens base64-encoded once more inside the secret value
+	// or token file.
+	TokenEncoding string `json:"tokenEncoding"`
+	// PreserveTokenWhitespace keeps leading and trailing whitespace of the
+	// token, which is trimmed by default.
+	PreserveTokenWhitespace bool `json:"preserveTokenWhitespace"`
+	// ZoneSecretKeyRefs maps zone suffixes to the secret holding the token
+	// for that zone. The longest suffix matching the challenge zone wins;
+	// the top-level token source is used when nothing matches.
+	ZoneSecretKeyRefs map[string]corev1.SecretKeySelector `json:"zoneSecretKeyRefs"`
+	// SecretCacheTTL is how long token secrets are cached in memory.
+	// Defaults to 30s.
+	SecretCacheTTL duration `json:"secretCacheTTL"`
+	// HTTPMethod selects how parameters are sent: GET (default) encodes them
+	// into the query string, POST sends them as a form body so the token
+	// does not end up in access logs.
+	HTTPMethod string `json:"httpMethod"`
+	// AuthMode selects how the token is sent: "query" (default) as the
+	// token parameter, "header" as an Authorization bearer token.
+	AuthMode string `json:"authMode"`
+	// AllowInsecureURL permits a plain http apiUrl. The token is then sent
+	// unencrypted, so this should only be used for local testing.
+	AllowInsecureURL bool `json:"allowInsecureURL"`
+	// TestMode is meant for CI runs against a mock or staging API. It
+	// permits plain http apiUrls like allowInsecureURL and marks every
+	// request with the X-Test-Traffic header.
+	TestMode bool `json:"testMode"`
+	// TestValue replaces the challenge key as the record value sent to the
+	// API, for deterministic tests against a fake server. It is only
+	// accepted together with testMode.
+	TestValue string `json:"testValue"`
+	// HTTPProxy is an explicit proxy URL for API requests. When unset, the
+	// HTTPS_PROXY, HTTP_PROXY and NO_PROXY environment variables apply.
+	HTTPProxy string `json:"httpProxy"`
+	// CABundle adds CA certificates to the trust pool for the API
+	// connection, given either as inline PEM or as the path to a PEM file.
+	CABundle string `json:"caBundle"`
+	// InsecureSkipVerify disables verification of the API's TLS
+	// certificate, for test gateways with self-signed certificates. It is
+	// only accepted together with testMode.
+	InsecureSkipVerify bool `json:"insecureSkipVerify"`
+	// IPFamily restricts API connections to "ipv4" or "ipv6" addresses,
+	// e.g. for IPv6-only clusters. Defaults to "auto", which uses either.
+	IPFamily string `json:"ipFamily"`
+	// MaxIdleConns caps the idle keep-alive connections kept across all
+	// API hosts. Defaults to 20.
+	MaxIdleConns int `json:"maxIdleConns"`
+	// MaxIdleConnsPerHost caps the idle keep-alive connections kept per API
+	// host. Defaults to 10.
+	MaxIdleConnsPerHost int `json:"maxIdleConnsPerHost"`
+	// IdleConnTimeout is how long an idle connection is kept open.
+	// Defaults to 90s.
+	IdleConnTimeout duration `json:"idleConnTimeout"`
+	// RecordTTL is the TTL in seconds requested for presented records. Zero
+	// leaves the TTL to the API default.
+	RecordTTL int `json:"recordTTL"`
+	// FollowCNAME resolves a CNAME at the challenge FQDN and sends the
+	// record for its target instead, for delegated _acme-challenge names.
+	FollowCNAME bool `json:"followCNAME"`
+	// ReplaceMode makes Present replace the whole record set at the FQDN
+	// with the challenge key and CleanUp clear it, instead of adding and
+	// removing single values. See callDoApi for the trade-offs. While
+	// another challenge is in progress at the same FQDN, e.g. for a
+	// wildcard and its apex, single values are added and removed instead.
+	ReplaceMode bool `json:"replaceMode"`
+	// ParamNames renames parameters of the letsencrypt endpoint, for
+	// gateways that expect e.g. txtvalue instead of value: token,
+	// account_id, domain, value, record_id, type, ttl and action. The
+	// names apply to every request and endpoint; parameters not listed
+	// keep their names.
+	ParamNames map[string]string `json:"paramNames"`
+	// PresentAction is sent as the action parameter when presenting a
+	// record. Empty, the default, sends none and relies on the API adding
+	// the value.
+	PresentAction string `json:"presentAction"`
+	// DeleteAction is sent as the action parameter when deleting records.
+	// Defaults to "delete".
+	DeleteAction string `json:"deleteAction"`
+	// RecordType is the type of the records sent to the API. Defaults to
+	// TXT, the only type accepted so far.
+	RecordType string `json:"recordType"`
+	// RecordNameFormat selects how the record name is sent: "fqdn"
+	// (default) as the full name without trailing dot, or "relative" to the
+	// challenge's resolved zone, e.g. "_acme-challenge" for example.com.
+	RecordNameFormat string `json:"recordNameFormat"`
+	// RecordNamePrefix replaces the leading _acme-challenge label of the
+	// record name sent to the API, for setups where _acme-challenge is
+	// delegated to a differently named record, e.g. "acme". Must be a
+	// single label. Empty, the default, keeps the name as is.
+	RecordNamePrefix string `json:"recordNamePrefix"`
+	// ValueEncoding is applied to the challenge key before it is sent as
+	// the value parameter: "raw" (default) sends it as is, "quoted" in
+	// double quotes and "base64" standard base64 encoded, for gateways
+	// that expect such a format. The gateway is expected to unwrap the
+	// quotes, which are zone file syntax, and to store base64 values as
+	// sent, so waitForPropagation and verifyDeletion look for the key and
+	// the encoded value respectively.
+	ValueEncoding string `json:"valueEncoding"`
+	// ChunkValue splits a value longer than 255 bytes, after valueEncoding,
+	// into 255-byte strings sent as "chunk1" "chunk2", the zone file format
+	// of a TXT record with several strings, for APIs that reject longer
+	// values. Shorter values, which all ACME challenge keys are, are sent
+	// unchanged. It cannot be combined with valueEncoding quoted.
+	ChunkValue bool `json:"chunkValue"`
+	// MaxResponseBodySize is the largest API response body in bytes that
+	// is accepted; longer responses fail the request. Defaults to 1 MiB.
+	MaxResponseBodySize int64 `json:"maxResponseBodySize"`
+	// SuccessStatusOnly treats any 2xx response as success without
+	// decoding the body, for gateways that answer with an empty or plain
+	// text body. API errors reported in the body then go unnoticed.
+	SuccessStatusOnly bool `json:"successStatusOnly"`
+	// MissingSuccess decides about a 2xx response whose body has neither a
+	// success nor a status field, e.g. "{}" from a gateway: "strict"
+	// (default) fails the request, "lenient" treats it as success and
+	// "warn" does so but logs a warning.
+	MissingSuccess string `json:"missingSuccess"`
+	// UserAgent is sent as the User-Agent header of API requests. Defaults
+	// to cert-manager-webhook-domain-offensive/<version>.
+	UserAgent string `json:"userAgent"`
+	// RequestHeaders are added to every API request, e.g. keys or tenant
+	// IDs required by a gateway in front of the API. Headers the solver
+	// sets itself, like Host, Authorization or User-Agent, cannot be
+	// overridden. Only static values are supported.
+	RequestHeaders map[string]string `json:"requestHeaders"`
+	// CleanupOrphans makes CleanUp also remove challenge values left at the
+	// FQDN by earlier runs. In records mode they are listed through the API,
+	// otherwise read from the nameservers given by propagationNameservers,
+	// or the zone's authoritative nameservers. TXT values that do not look
+	// like challenge keys once decoded from valueEncoding are kept. Has no
+	// effect in replace mode, which clears the record set anyway, or in test
+	// mode with a testValue.
+	CleanupOrphans bool `json:"cleanupOrphans"`
+	// VerifyDeletion makes CleanUp poll the nameservers given by
+	// propagationNameservers, or the zone's authoritative nameservers,
+	// until none of them serves the challenge value any more, at the CNAME
+	// target with followCNAME. CleanUp fails
+	// if the value is still served after verifyDeletionTimeout, so
+	// cert-manager retries the cleanup.
+	VerifyDeletion bool `json:"verifyDeletion"`
+	// VerifyDeletionTimeout bounds the deletion check. It is separate from
+	// cleanupTimeout, which only covers the API requests. Defaults to 1m.
+	VerifyDeletionTimeout duration `json:"verifyDeletionTimeout"`
+	// DomainAllowlist restricts the challenge FQDNs the solver operates
+	// on to these domain suffixes, as a guardrail for shared issuers:
+	// "example.com" allows _acme-challenge.example.com and any name below
+	// example.com, including those of wildcard certificates. Present and
+	// CleanUp reject other FQDNs before any API request. Empty, the
+	// default, allows every domain.
+	DomainAllowlist []string `json:"domainAllowlist"`
+	// DomainDenylist blocks challenge FQDNs matching these domain
+	// suffixes, e.g. sensitive subdomains, the same way domainAllowlist
+	// matches. Present rejects them before any API request, even if they
+	// are also allowlisted.
+	DomainDenylist []string `json:"domainDenylist"`
+	// ZoneOverride replaces the challenge's resolved zone within the
+	// solver, for delegated CNAME setups where the token manages a
+	// different zone than cert-manager resolved: relative record names,
+	// zone paths sent to the API and the zoneSecretKeyRefs lookup use it
+	// instead. It does not change how cert-manager resolves the zone, nor
+	// the zone check of skipZoneCheck.
+	ZoneOverride string `json:"zoneOverride"`
+	// SkipZoneCheck allows challenges whose FQDN is not within their
+	// resolved zone, for unusual delegation setups. By default they are
+	// rejected before any API request is made.
+	SkipZoneCheck bool `json:"skipZoneCheck"`
+	// IgnoreUnknownFields accepts config fields this version of the
+	// solver does not know, e.g. while rolling back from a newer one. By
+	// default they are rejected, so that misspelled fields do not go
+	// unnoticed.
+	IgnoreUnknownFields bool `json:"ignoreUnknownFields"`
+	// DryRun logs the API requests that would be sent, with the token
+	// redacted, and reports success without sending them.
+	DryRun bool `json:"dryRun"`
+
+	// accountID is read from AccountIDSecretKeyRef by the solver before
+	// any API request; it is not part of the JSON config.
+	accountID string
+	// apiPath is ApiPathTemplate as parsed by loadConfig, or nil.
+	apiPath *template.Template
+}
+
+// zone returns the zone the solver works with for ch: zoneOverride if set,
+// the resolved zone otherwise.
+func (cfg domainOffensiveDNSProviderConfig) zone(ch *v1alpha1.ChallengeRequest) string {
+	if cfg.ZoneOverride != "" {
+		return cfg.ZoneOverride
+	}
+	return ch.ResolvedZone
+}
+
+// resolvers returns the recursive resolvers to use for DNS lookups.
+func (cfg domainOffensiveDNSProviderConfig) resolvers() []string {
+	if len(cfg.DNSResolvers) > 0 {
+		return cfg.DNSResolvers
+	}
+	return util.RecursiveNameservers
+}
+
+// redacted returns a copy of cfg that is safe to expose, with credentials
+// embedded in any field masked.
+func (cfg domainOffensiveDNSProviderConfig) redacted() domainOffensiveDNSProviderConfig {
+	cfg.HTTPProxy = redactURL(cfg.HTTPProxy)
+	if len(cfg.RequestHeaders) > 0 {
+		headers := make(map[string]string, len(cfg.RequestHeaders))
+		for k := range cfg.RequestHeaders {
+			headers[k] = redactedPlaceholder
+		}
+		cfg.RequestHeaders = headers
+	}
+	return cfg
+}
+
+// endpointList is a list of API endpoints that is decoded from either a
+// single string or an array of strings.
+type endpointList []string
+
+func (l *endpointList) UnmarshalJSON(b []byte) error {
+	var single string
+	if err := json.Unmarshal(b, &single); err == nil {
+		*l = endpointList{}
+		if single != "" {
+			*l = endpointList{single}
+		}
+		return nil
+	}
+	var list []string
+	if err := json.Unmarshal(b, &list); err != nil {
+		return fmt.Errorf("apiUrl must be a string or a list of strings: %v", err)
+	}
+	*l = list
+	return nil
+}
+
+// duration is a time.Duration that is decoded from a Go duration string
+// such as "30s" in the solver config.
+type duration struct {
+	time.Duration
+}
+
+func (d *duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("duration must be a string: %v", err)
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	d.Duration = v
+	return nil
+}
+
+func (d duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
 }
 
 func (c *domainOffensiveDNSProviderSolver) Name() string {
 	return "domain-offensive"
 }
 
-func (c *domainOffensiveDNSProviderSolver) Present(ch *v1alpha1.ChallengeRequest) error {
+func (c *domainOffensiveDNSProviderSolver) Present(ch *v1alpha1.ChallengeRequest) (err error) {
+	start := time.Now()
+	status := statusConfigError
+	ctx, span := startSpan(c.baseContext(), operationPresent, ch)
+	defer func() {
+		if err == nil {
+			status = resultSuccess
+		}
+		endSpan(span, ch, status, err)
+		observeOperation(operationPresent, status)
+		logEvent(operationEvent{Message: "present finished", Operation: operationPresent, Challenge: ch, Status: status, Start: start, Err: err})
+		if err != nil {
+			c.recordFailure(ch, reasonPresentFailed, err)
+		}
+	}()
+
 	klog.Infof("call function Present: namespace=%s, zone=%s, fqdn=%s",
 		ch.ResourceNamespace, ch.ResolvedZone, ch.ResolvedFQDN)
 
+	// an empty value would be accepted by the API as a bogus record
+	if ch.Key == "" {
+		return fmt.Errorf("%w: refusing to present %s", ErrEmptyChallengeKey, ch.ResolvedFQDN)
+	}
+
 	cfg, err := loadConfig(ch.Config)
 	if err != nil {
 		return err
 	}
+	c.configs.record(ch.ResourceNamespace, cfg)
 
-	if cfg.SecretKeyRef.Key == "" { return errors.New("missing SecretKeyRef") }
-	sec, err := c.client.CoreV1().Secrets(ch.ResourceNamespace).Get(context.TODO(), cfg.SecretKeyRef.Name, v1.GetOptions{})
+	if ch, err = c.withResolvedZone(ctx, ch, cfg.resolvers()); err != nil {
+		return err
+	}
+	if !cfg.SkipZoneCheck {
+		if err := checkFQDNInZone(ch.ResolvedFQDN, ch.ResolvedZone); err != nil {
+			return err
+		}
+	}
+	if err := checkDomainDenied(ch.ResolvedFQDN, cfg.DomainDenylist); err != nil {
+		return err
+	}
+	if err := checkDomainAllowed(ch.ResolvedFQDN, cfg.DomainAllowlist); err != nil {
+		return err
+	}
+	// with followCNAME the record is written to the CNAME target, which
+	// domainDenylist and domainAllowlist apply to as well
+	rec, err := resolveChallengeRecord(ctx, ch, cfg)
 	if err != nil {
-		return fmt.Errorf("unable to get secret `%s/%s`; %v", ch.ResourceNamespace, cfg.SecretKeyRef.Name, err)
+		return err
 	}
-
-	token, err := stringFromSecretData(sec.Data, "token")
+	if err := checkDomainDenied(rec.fqdn, cfg.DomainDenylist); err != nil {
+		return err
+	}
+	if err := checkDomainAllowed(rec.fqdn, cfg.DomainAllowlist); err != nil {
+		return err
+	}
+	token, err := c.loadSecrets(ctx, ch, &cfg)
+	if err != nil {
+		status = resultSecretError
+		return err
+	}
+	client, err := c.apiClient(cfg)
 	if err != nil {
 		return err
 	}
+	if c.health != nil {
+		c.health.setURL(cfg.ApiURL[0], client, secretURL(cfg) != "")
+	}
 
-	if err := presentRecord(ch, cfg.ApiURL, token); err != nil {
+	status = resultAPIError
+	if cfg.PresentJitter.Duration > 0 && !cfg.DryRun {
+		if err := sleepContext(ctx, rand.N(cfg.PresentJitter.Duration)); err != nil {
+			return err
+		}
+	}
+	if others := c.active.add(ch.ResolvedFQDN, ch.Key); len(others) > 0 {
+		// expected for a wildcard and apex pair, which share the name
+		logEvent(operationEvent{
+			Message:   fmt.Sprintf("overlapping challenges: key %q presented while keys %q are active for the same name", ch.Key, others),
+			Operation: operationPresent, Challenge: ch, Status: status, Start: start, Warning: true,
+		})
+	}
+	c.reconciler.track(ch, cfg)
+	cfg = c.sharedFQDNConfig(ch, cfg)
+	if err := presentRecord(ctx, client, ch, cfg, token, c.recordIDs); err != nil {
+		c.active.remove(ch.ResolvedFQDN, ch.Key)
+		c.invalidateToken(ch, cfg)
 		return err
 	}
 
+	if cfg.PresentDelay.Duration > 0 && !cfg.DryRun {
+		klog.Infof("waiting %v before returning from present for %v", cfg.PresentDelay, ch.ResolvedFQDN)
+		if err := sleepContext(ctx, cfg.PresentDelay.Duration); err != nil {
+			return err
+		}
+	}
+
+	if cfg.WaitForPropagation && !cfg.DryRun {
+		status = statusPropagationError
+		if err := waitForPropagation(ctx, rec.fqdn, rec.served, cfg.PropagationNameservers, cfg.resolvers(), cfg.PropagationTimeout.Duration); err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
 
 func (c *domainOffensiveDNSProviderSolver) CleanUp(ch *v1alpha1.ChallengeRequest) error {
+	return c.cleanUp(c.baseContext(), ch)
+}
+
+// cleanUp removes the record of ch, with parent bounding all secret lookups
+// and API requests.
+func (c *domainOffensiveDNSProviderSolver) cleanUp(parent context.Context, ch *v1alpha1.ChallengeRequest) (err error) {
+	start := time.Now()
+	status := statusConfigError
+	parent, span := startSpan(parent, operationCleanup, ch)
+	defer func() {
+		if err == nil {
+			status = resultSuccess
+		}
+		endSpan(span, ch, status, err)
+		observeOperation(operationCleanup, status)
+		logEvent(operationEvent{Message: "cleanup finished", Operation: operationCleanup, Challenge: ch, Status: status, Start: start, Err: err})
+		if err != nil {
+			c.recordFailure(ch, reasonCleanUpFailed, err)
+		}
+	}()
+
 	klog.Infof("call function CleanUp: namespace=%s, zone=%s, fqdn=%s",
 		ch.ResourceNamespace, ch.ResolvedZone, ch.ResolvedFQDN)
 
+	// Without a key there is no way to tell which value to remove, and
+	// deleting every challenge value could break other challenges in
+	// progress, so this is an error rather than a wildcard delete.
+	if ch.Key == "" {
+		return fmt.Errorf("%w: refusing to clean up %s", ErrEmptyChallengeKey, ch.ResolvedFQDN)
+	}
+
 	cfg, err := loadConfig(ch.Config)
 	if err != nil {
 		return err
 	}
+	c.configs.record(ch.ResourceNamespace, cfg)
 
-	if cfg.SecretKeyRef.Key == "" { return errors.New("missing SecretKeyRef") }
-	sec, err := c.client.CoreV1().Secrets(ch.ResourceNamespace).Get(context.TODO(), cfg.SecretKeyRef.Name, v1.GetOptions{})
+	ctx, cancel := context.WithTimeout(parent, cfg.CleanupTimeout.Duration)
+	defer cancel()
+
+	if ch, err = c.withResolvedZone(ctx, ch, cfg.resolvers()); err != nil {
+		return err
+	}
+	if !cfg.SkipZoneCheck {
+		if err := checkFQDNInZone(ch.ResolvedFQDN, ch.ResolvedZone); err != nil {
+			return err
+		}
+	}
+	if err := checkDomainAllowed(ch.ResolvedFQDN, cfg.DomainAllowlist); err != nil {
+		return err
+	}
+	// with followCNAME the record is written to the CNAME target, which
+	// the allowlist has to cover as well
+	rec, err := resolveChallengeRecord(ctx, ch, cfg)
 	if err != nil {
-		return fmt.Errorf("unable to get secret `%s/%s`; %v", ch.ResourceNamespace, cfg.SecretKeyRef.Name, err)
+		return err
 	}
-
-	token, err := stringFromSecretData(sec.Data, "token")
+	if err := checkDomainAllowed(rec.fqdn, cfg.DomainAllowlist); err != nil {
+		return err
+	}
+	token, err := c.loadSecrets(ctx, ch, &cfg)
+	if err != nil {
+		status = resultSecretError
+		return err
+	}
+	client, err := c.apiClient(cfg)
 	if err != nil {
 		return err
 	}
+	if c.health != nil {
+		c.health.setURL(cfg.ApiURL[0], client, secretURL(cfg) != "")
+	}
 
-	if err := deleteRecord(ch, cfg.ApiURL, token); err != nil {
+	status = resultAPIError
+	cfg = c.sharedFQDNConfig(ch, cfg)
+	if err := deleteRecord(ctx, client, ch, cfg, token, c.recordIDs); err != nil {
+		c.invalidateToken(ch, cfg)
 		return err
 	}
+	c.active.remove(ch.ResolvedFQDN, ch.Key)
+
+	if cfg.CleanupOrphans && !cfg.ReplaceMode {
+		if err := c.cleanupOrphans(ctx, client, ch, cfg, token); err != nil {
+			return fmt.Errorf("failed to clean up orphaned records: %w", err)
+		}
+	}
+
+	if cfg.VerifyDeletion && !cfg.DryRun {
+		status = statusPropagationError
+		if err := waitForDeletion(parent, rec.fqdn, rec.served, cfg.PropagationNameservers, cfg.resolvers(), cfg.VerifyDeletionTimeout.Duration); err != nil {
+			return err
+		}
+	}
 
 	return nil
 }
 
 func (c *domainOffensiveDNSProviderSolver) Initialize(kubeClientConfig *rest.Config, stopCh <-chan struct{}) error {
+	if err := validateEnvironment(); err != nil {
+		return fmt.Errorf("invalid environment: %w", err)
+	}
 
 	cl, err := kubernetes.NewForConfig(kubeClientConfig)
 	if err != nil {
 		return err
 	}
 	c.client = cl
+	c.secrets = newSecretCache()
+	limits, err := newStateLimitsFromEnv()
+	if err != nil {
+		return err
+	}
+	c.active = newActiveKeys()
+	c.active.limits = limits
+	c.recordIDs = newRecordIDStore()
+	c.recordIDs.limits = limits
+	limiter, err := newRateLimiterFromEnv()
+	if err != nil {
+		return err
+	}
+	sem, err := newRequestSemaphoreFromEnv()
+	if err != nil {
+		return err
+	}
+	breakers, err := newCircuitBreakersFromEnv()
+	if err != nil {
+		return err
+	}
+	c.clients = newClientCache(limiter, sem, breakers)
+
+	cmcl, err := cmclient.NewForConfig(kubeClientConfig)
+	if err != nil {
+		return err
+	}
+	c.cmClient = cmcl
+
+	recorder, broadcaster := newEventRecorder(cl)
+	c.recorder = recorder
+
+	shutdownCleanup, err := shutdownCleanupFromEnv()
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	c.shutdownDone = make(chan struct{})
+	go func() {
+		defer close(c.shutdownDone)
+		<-stopCh
+		cancel()
+		if shutdownCleanup {
+			c.cleanupOutstanding(shutdownCleanupTimeout)
+		}
+		broadcaster.Shutdown()
+	}()
+	c.ctx = ctx
+
+	c.configs = newConfigStore()
+	if port := os.Getenv("STATUS_PORT"); port != "" {
+		health, err := newAPIHealthCheckerFromEnv()
+		if err != nil {
+			return err
+		}
+		c.health = health
+		go health.run(ctx)
+
+		mux := http.NewServeMux()
+		mux.Handle("/healthz", health)
+		mux.Handle("/config", c.configs)
+		mux.HandleFunc("/version", serveVersion)
+		serveStatus(ctx, port, mux)
+	}
+
+	if c.reconciler, err = newReconcilerFromEnv(); err != nil {
+		return err
+	}
+	if c.reconciler != nil {
+		go c.runReconciler(ctx)
+	}
+
+	selfTest, err := selfTestFromEnv()
+	if err != nil {
+		return err
+	}
+	if selfTest != nil {
+		go func() {
+			if err := c.selfTest(selfTest); err != nil {
+				klog.Error(err)
+			}
+		}()
+	}
 
 	return nil
 }
 
+// sharedFQDNConfig turns off replace mode for ch if another challenge is in
+// progress at its FQDN, typically the apex next to a wildcard, so both values
+// coexist and cleaning up one leaves the other in place.
+func (c *domainOffensiveDNSProviderSolver) sharedFQDNConfig(ch *v1alpha1.ChallengeRequest, cfg domainOffensiveDNSProviderConfig) domainOffensiveDNSProviderConfig {
+	if !cfg.ReplaceMode || !c.active.hasOthers(ch.ResolvedFQDN, ch.Key) {
+		return cfg
+	}
+	kind := "apex"
+	if isWildcardChallenge(ch) {
+		kind = "wildcard"
+	}
+	klog.Infof("another challenge is in progress at %v, not replacing the record set for the %s challenge of %s", ch.ResolvedFQDN, kind, ch.DNSName)
+	cfg.ReplaceMode = false
+	return cfg
+}
+
+// shutdownCleanupFromEnv reads SHUTDOWN_CLEANUP, which enables
+// cleanupOutstanding when the webhook stops. It is off by default: during a
+// rolling restart the outstanding challenges may still be validated while
+// the new pod takes them over, and deleting their records would fail them.
+func shutdownCleanupFromEnv() (bool, error) {
+	v := os.Getenv("SHUTDOWN_CLEANUP")
+	if v == "" {
+		return false, nil
+	}
+	enabled, err := strconv.ParseBool(v)
+	if err != nil {
+		return false, fmt.Errorf("SHUTDOWN_CLEANUP must be true or false, got %q", v)
+	}
+	return enabled, nil
+}
+
+// cleanupOutstanding makes a best-effort attempt to delete the records that
+// were presented but not cleaned up yet, so they do not leak when the pod is
+// terminated mid-challenge. It gives up after timeout.
+func (c *domainOffensiveDNSProviderSolver) cleanupOutstanding(timeout time.Duration) {
+	pending := c.recordIDs.outstanding()
+	if len(pending) == 0 {
+		return
+	}
+	klog.Infof("shutting down, cleaning up %d outstanding records", len(pending))
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	for _, ch := range pending {
+		klog.Infof("shutdown cleanup of acme txt record %v", ch.ResolvedFQDN)
+		if err := c.cleanUp(ctx, ch); err != nil {
+			klog.Errorf("shutdown cleanup of acme txt record %v failed: %v", ch.ResolvedFQDN, err)
+		}
+	}
+}
+
+// waitForShutdown blocks until the cleanup started when the webhook server
+// stops is done. It returns right away if the solver was not initialized.
+func (c *domainOffensiveDNSProviderSolver) waitForShutdown() {
+	if c.shutdownDone != nil {
+		<-c.shutdownDone
+	}
+}
+
+// withResolvedZone returns ch with its zone discovered through SOA lookups
+// if cert-manager left ResolvedZone empty, as happens in some delegated
+// setups. ch itself is not modified.
+func (c *domainOffensiveDNSProviderSolver) withResolvedZone(ctx context.Context, ch *v1alpha1.ChallengeRequest, resolvers []string) (*v1alpha1.ChallengeRequest, error) {
+	if ch.ResolvedZone != "" {
+		return ch, nil
+	}
+	nameservers := c.nameservers
+	if len(nameservers) == 0 {
+		nameservers = resolvers
+	}
+	zone, err := findZone(ctx, ch.ResolvedFQDN, nameservers)
+	if err != nil {
+		return ch, err
+	}
+	klog.Infof("challenge for %s has no resolved zone, using discovered zone %s", ch.ResolvedFQDN, zone)
+	resolved := *ch
+	resolved.ResolvedZone = zone
+	return &resolved, nil
+}
+
+// apiClient returns the http client used for API requests with cfg.
+func (c *domainOffensiveDNSProviderSolver) apiClient(cfg domainOffensiveDNSProviderConfig) (*http.Client, error) {
+	if c.httpClient != nil {
+		return c.httpClient, nil
+	}
+	if cfg.InsecureSkipVerify {
+		endpoints := []string(cfg.ApiURL)
+		if secretURL(cfg) != "" {
+			endpoints = []string{redactedPlaceholder}
+		}
+		klog.Warningf("TLS certificate verification is DISABLED for API requests to %v (insecureSkipVerify); never use this in production", endpoints)
+	}
+	return c.clients.get(transportOptionsFor(cfg))
+}
+
+// baseContext returns the context bound to the lifetime of the webhook
+// server, or a background context if the solver was not initialized.
+func (c *domainOffensiveDNSProviderSolver) baseContext() context.Context {
+	if c.ctx == nil {
+		return context.Background()
+	}
+	return c.ctx
+}
+
 // loadConfig is a small helper function that decodes JSON configuration into
 // the typed config struct.
 func loadConfig(cfgJSON *extapi.JSON) (domainOffensiveDNSProviderConfig, error) {
 	cfg := domainOffensiveDNSProviderConfig{}
 	// handle the 'base case' where no configuration has been provided
-	if cfgJSON == nil {
-		return cfg, nil
+	if cfgJSON != nil {
+		if err := json.Unmarshal(cfgJSON.Raw, &cfg); err != nil {
+			return cfg, fmt.Errorf("error decoding solver config: %v", err)
+		}
+		if !cfg.IgnoreUnknownFields {
+			if err := checkUnknownFields(cfgJSON.Raw); err != nil {
+				return cfg, err
+			}
+		}
 	}
 
-	if err := json.Unmarshal(cfgJSON.Raw, &cfg); err != nil {
-		return cfg, fmt.Errorf("error decoding solver config: %v", err)
+	if err := validateTokenSource(cfg); err != nil {
+		return cfg, err
 	}
 
-	if cfg.ApiURL == "" {
-		cfg.ApiURL = "https://my.do.de/api/letsencrypt"
+	switch cfg.ApiMode {
+	case "":
+		cfg.ApiMode = apiModeLetsEncrypt
+	case apiModeLetsEncrypt, apiModeRecords:
+	default:
+		return cfg, fmt.Errorf("apiMode must be %q or %q, got %q", apiModeLetsEncrypt, apiModeRecords, cfg.ApiMode)
+	}
+	if len(cfg.ApiURL) == 0 {
+		cfg.ApiURL = endpointList{defaultApiURL}
+		if cfg.ApiMode == apiModeRecords {
+			cfg.ApiURL = endpointList{defaultRecordsApiURL}
+		}
+	}
+	for _, endpoint := range cfg.ApiURL {
+		if err := validateApiURL(endpoint, cfg.AllowInsecureURL || cfg.TestMode); err != nil {
+			return cfg, err
+		}
+	}
+	if cfg.ApiPathTemplate != "" {
+		if cfg.ApiMode == apiModeRecords {
+			return cfg, errors.New("apiPathTemplate is not supported with apiMode records")
+		}
+		tmpl, err := parseAPIPathTemplate(cfg.ApiPathTemplate)
+		if err != nil {
+			return cfg, err
+		}
+		cfg.apiPath = tmpl
+	}
+	if cfg.InsecureSkipVerify && !cfg.TestMode {
+		return cfg, errors.New("insecureSkipVerify is only allowed together with testMode")
+	}
+	if cfg.TestValue != "" && !cfg.TestMode {
+		return cfg, errors.New("testValue is only allowed together with testMode")
+	}
+	if cfg.HTTPProxy != "" {
+		if _, err := parseProxyURL(cfg.HTTPProxy); err != nil {
+			return cfg, err
+		}
+	}
+
+	if cfg.CABundle != "" {
+		if _, err := loadCABundle(cfg.CABundle); err != nil {
+			return cfg, err
+		}
+	}
+
+	cfg.HTTPMethod = strings.ToUpper(cfg.HTTPMethod)
+	switch cfg.HTTPMethod {
+	case "":
+		cfg.HTTPMethod = http.MethodGet
+	case http.MethodGet, http.MethodPost:
+	default:
+		return cfg, fmt.Errorf("httpMethod must be GET or POST, got %q", cfg.HTTPMethod)
+	}
+	switch cfg.TokenEncoding {
+	case "":
+		cfg.TokenEncoding = tokenEncodingRaw
+	case tokenEncodingRaw, tokenEncodingBase64:
+	default:
+		return cfg, fmt.Errorf("tokenEncoding must be %q or %q, got %q", tokenEncodingRaw, tokenEncodingBase64, cfg.TokenEncoding)
+	}
+	switch cfg.AuthMode {
+	case "":
+		cfg.AuthMode = authModeQuery
+	case authModeQuery, authModeHeader:
+	default:
+		return cfg, fmt.Errorf("authMode must be %q or %q, got %q", authModeQuery, authModeHeader, cfg.AuthMode)
+	}
+
+	switch cfg.IPFamily {
+	case "":
+		cfg.IPFamily = ipFamilyAuto
+	case ipFamilyAuto, ipFamilyIPv4, ipFamilyIPv6:
+	default:
+		return cfg, fmt.Errorf("ipFamily must be %q, %q or %q, got %q", ipFamilyAuto, ipFamilyIPv4, ipFamilyIPv6, cfg.IPFamily)
+	}
+
+	switch cfg.BackoffStrategy {
+	case "":
+		cfg.BackoffStrategy = backoffExponential
+	case backoffFixed, backoffLinear, backoffExponential:
+	default:
+		return cfg, fmt.Errorf("backoffStrategy must be %q, %q or %q, got %q", backoffFixed, backoffLinear, backoffExponential, cfg.BackoffStrategy)
+	}
+
+	switch cfg.ValueEncoding {
+	case "":
+		cfg.ValueEncoding = valueEncodingRaw
+	case valueEncodingRaw, valueEncodingQuoted, valueEncodingBase64:
+	default:
+		return cfg, fmt.Errorf("valueEncoding must be %q, %q or %q, got %q", valueEncodingRaw, valueEncodingQuoted, valueEncodingBase64, cfg.ValueEncoding)
+	}
+
+	if cfg.ChunkValue && cfg.ValueEncoding == valueEncodingQuoted {
+		return cfg, errors.New("chunkValue cannot be combined with valueEncoding quoted, chunks are quoted already")
+	}
+
+	switch cfg.MissingSuccess {
+	case "":
+		cfg.MissingSuccess = missingSuccessStrict
+	case missingSuccessStrict, missingSuccessLenient, missingSuccessWarn:
+	default:
+		return cfg, fmt.Errorf("missingSuccess must be %q, %q or %q, got %q", missingSuccessStrict, missingSuccessLenient, missingSuccessWarn, cfg.MissingSuccess)
+	}
+
+	if cfg.UserAgent == "" {
+		cfg.UserAgent = defaultUserAgent()
+	}
+	if err := validateRequestHeaders(cfg.RequestHeaders); err != nil {
+		return cfg, err
+	}
+	if err := validateParamNames(cfg.ParamNames); err != nil {
+		return cfg, err
+	}
+	if cfg.DeleteAction == "" {
+		cfg.DeleteAction = defaultDeleteAction
+	}
+
+	cfg.RecordType = strings.ToUpper(cfg.RecordType)
+	if cfg.RecordType == "" {
+		cfg.RecordType = supportedRecordTypes[0]
+	}
+	if !slices.Contains(supportedRecordTypes, cfg.RecordType) {
+		return cfg, fmt.Errorf("recordType must be one of %v, got %q", supportedRecordTypes, cfg.RecordType)
+	}
+
+	switch cfg.RecordNameFormat {
+	case "":
+		cfg.RecordNameFormat = recordNameFQDN
+	case recordNameFQDN, recordNameRelative:
+	default:
+		return cfg, fmt.Errorf("recordNameFormat must be %q or %q, got %q", recordNameFQDN, recordNameRelative, cfg.RecordNameFormat)
+	}
+	if cfg.RecordNamePrefix != "" {
+		if !isDNSLabel(cfg.RecordNamePrefix) {
+			return cfg, fmt.Errorf("recordNamePrefix must be a single DNS label, got %q", cfg.RecordNamePrefix)
+		}
+	}
+
+	for i, suffix := range cfg.DomainAllowlist {
+		if !isDNSName(suffix) {
+			return cfg, fmt.Errorf("domainAllowlist[%d] must be a valid DNS name, got %q", i, suffix)
+		}
+		cfg.DomainAllowlist[i] = normalizeDomain(suffix)
+	}
+	for i, suffix := range cfg.DomainDenylist {
+		if !isDNSName(suffix) {
+			return cfg, fmt.Errorf("domainDenylist[%d] must be a valid DNS name, got %q", i, suffix)
+		}
+		cfg.DomainDenylist[i] = normalizeDomain(suffix)
+	}
+	if cfg.ZoneOverride != "" {
+		if !isDNSName(cfg.ZoneOverride) {
+			return cfg, fmt.Errorf("zoneOverride must be a valid DNS name, got %q", cfg.ZoneOverride)
+		}
+		cfg.ZoneOverride = util.ToFqdn(strings.ToLower(cfg.ZoneOverride))
+	}
+
+	for i, ns := range cfg.PropagationNameservers {
+		addr, err := nameserverAddress(ns)
+		if err != nil {
+			return cfg, fmt.Errorf("propagationNameservers[%d]: %v", i, err)
+		}
+		cfg.PropagationNameservers[i] = addr
+	}
+	for i, ns := range cfg.DNSResolvers {
+		addr, err := nameserverAddress(ns)
+		if err != nil {
+			return cfg, fmt.Errorf("dnsResolvers[%d]: %v", i, err)
+		}
+		cfg.DNSResolvers[i] = addr
+	}
+
+	if cfg.RetryMaxAttempts < 0 || cfg.RetryMaxAttempts > maxRetryAttempts {
+		return cfg, fmt.Errorf("retryMaxAttempts must be between 0 and %d, got %d", maxRetryAttempts, cfg.RetryMaxAttempts)
+	}
+	if cfg.RetryMaxAttempts == 0 {
+		cfg.RetryMaxAttempts = defaultRetryMaxAttempts
+	}
+	for _, n := range []struct {
+		field string
+		value *int
+		def   int
+	}{
+		{"maxIdleConns", &cfg.MaxIdleConns, defaultMaxIdleConns},
+		{"maxIdleConnsPerHost", &cfg.MaxIdleConnsPerHost, defaultMaxIdleConnsPerHost},
+	} {
+		if *n.value < 0 {
+			return cfg, fmt.Errorf("%s must not be negative, got %d", n.field, *n.value)
+		}
+		if *n.value == 0 {
+			*n.value = n.def
+		}
+	}
+	if cfg.MaxResponseBodySize < 0 {
+		return cfg, fmt.Errorf("maxResponseBodySize must not be negative, got %d", cfg.MaxResponseBodySize)
+	}
+	if cfg.MaxResponseBodySize == 0 {
+		cfg.MaxResponseBodySize = defaultMaxResponseBodySize
+	}
+	if cfg.RecordTTL < 0 || cfg.RecordTTL > maxRecordTTL {
+		return cfg, fmt.Errorf("recordTTL must be between 0 and %d, got %d", maxRecordTTL, cfg.RecordTTL)
+	}
+
+	for _, d := range []struct {
+		field string
+		value *duration
+		def   time.Duration
+	}{
+		{"httpTimeout", &cfg.HTTPTimeout, defaultHTTPTimeout},
+		{"retryBaseDelay", &cfg.RetryBaseDelay, defaultRetryBaseDelay},
+		{"retryAfterMax", &cfg.RetryAfterMax, defaultRetryAfterMax},
+		{"secretCacheTTL", &cfg.SecretCacheTTL, defaultSecretCacheTTL},
+		{"propagationTimeout", &cfg.PropagationTimeout, defaultPropagationTimeout},
+		{"verifyDeletionTimeout", &cfg.VerifyDeletionTimeout, defaultVerifyDeletionTimeout},
+		{"presentDelay", &cfg.PresentDelay, 0},
+		{"presentJitter", &cfg.PresentJitter, 0},
+		{"idleConnTimeout", &cfg.IdleConnTimeout, defaultIdleConnTimeout},
+		{"cleanupTimeout", &cfg.CleanupTimeout, 0},
+		{"slowCallThreshold", &cfg.SlowCallThreshold, defaultSlowCallThreshold},
+	} {
+		if d.value.Duration < 0 {
+			return cfg, fmt.Errorf("%s must not be negative, got %v", d.field, d.value)
+		}
+		if d.value.Duration == 0 {
+			d.value.Duration = d.def
+		}
+	}
+	if cfg.CleanupTimeout.Duration == 0 {
+		cfg.CleanupTimeout = cfg.HTTPTimeout
 	}
 
 	klog.InfoS("Solver configuration loaded",
-		"apiUrl", cfg.ApiURL,
+		"apiMode", cfg.ApiMode,
+		"apiUrl", []string(cfg.ApiURL),
+		"apiUrlSecretKeyRef", cfg.ApiURLSecretKeyRef,
+		"apiPathTemplate", cfg.ApiPathTemplate,
 		"secretKeyRef", cfg.SecretKeyRef,
+		"tokenFile", cfg.TokenFile,
+		"tokenEncoding", cfg.TokenEncoding,
+		"preserveTokenWhitespace", cfg.PreserveTokenWhitespace,
+		"zoneSecretKeyRefs", cfg.ZoneSecretKeyRefs,
+		"accountIdSecretKeyRef", cfg.AccountIDSecretKeyRef,
+		"secretCacheTTL", cfg.SecretCacheTTL,
+		"httpMethod", cfg.HTTPMethod,
+		"authMode", cfg.AuthMode,
+		"allowInsecureURL", cfg.AllowInsecureURL,
+		"testMode", cfg.TestMode,
+		"testValue", cfg.TestValue,
+		"httpProxy", redactURL(cfg.HTTPProxy),
+		"caBundle", cfg.CABundle != "",
+		"insecureSkipVerify", cfg.InsecureSkipVerify,
+		"ipFamily", cfg.IPFamily,
+		"maxIdleConns", cfg.MaxIdleConns,
+		"maxIdleConnsPerHost", cfg.MaxIdleConnsPerHost,
+		"idleConnTimeout", cfg.IdleConnTimeout,
+		"recordTTL", cfg.RecordTTL,
+		"followCNAME", cfg.FollowCNAME,
+		"replaceMode", cfg.ReplaceMode,
+		"cleanupOrphans", cfg.CleanupOrphans,
+		"verifyDeletion", cfg.VerifyDeletion,
+		"verifyDeletionTimeout", cfg.VerifyDeletionTimeout,
+		"recordType", cfg.RecordType,
+		"paramNames", cfg.ParamNames,
+		"presentAction", cfg.PresentAction,
+		"deleteAction", cfg.DeleteAction,
+		"domainAllowlist", cfg.DomainAllowlist,
+		"domainDenylist", cfg.DomainDenylist,
+		"zoneOverride", cfg.ZoneOverride,
+		"skipZoneCheck", cfg.SkipZoneCheck,
+		"recordNameFormat", cfg.RecordNameFormat,
+		"recordNamePrefix", cfg.RecordNamePrefix,
+		"valueEncoding", cfg.ValueEncoding,
+		"chunkValue", cfg.ChunkValue,
+		"userAgent", cfg.UserAgent,
+		"requestHeaders", headerNames(cfg.RequestHeaders),
+		"successStatusOnly", cfg.SuccessStatusOnly,
+		"missingSuccess", cfg.MissingSuccess,
+		"maxResponseBodySize", cfg.MaxResponseBodySize,
+		"ignoreUnknownFields", cfg.IgnoreUnknownFields,
+		"dryRun", cfg.DryRun,
+		"httpTimeout", cfg.HTTPTimeout,
+		"cleanupTimeout", cfg.CleanupTimeout,
+		"slowCallThreshold", cfg.SlowCallThreshold,
+		"retryMaxAttempts", cfg.RetryMaxAttempts,
+		"retryBaseDelay", cfg.RetryBaseDelay,
+		"backoffStrategy", cfg.BackoffStrategy,
+		"retryAfterMax", cfg.RetryAfterMax,
+		"waitForPropagation", cfg.WaitForPropagation,
+		"propagationTimeout", cfg.PropagationTimeout,
+		"presentDelay", cfg.PresentDelay,
+		"presentJitter", cfg.PresentJitter,
+		"propagationNameservers", cfg.PropagationNameservers,
+		"dnsResolvers", cfg.DNSResolvers,
 	)
 
 	return cfg, nil
 }
 
+// checkUnknownFields decodes raw once more, rejecting fields the config does
+// not have, so misspelled keys fail instead of silently leaving the default.
+// Like json.Unmarshal, it matches field names case-insensitively.
+func checkUnknownFields(raw []byte) error {
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.DisallowUnknownFields()
+	var cfg domainOffensiveDNSProviderConfig
+	if err := dec.Decode(&cfg); err != nil {
+		return fmt.Errorf("error decoding solver config: %v; set ignoreUnknownFields to accept fields this version does not know", err)
+	}
+	return nil
+}
+
+// validateApiURL checks that raw is an absolute https URL, or http if
+// allowInsecure is set.
+func validateApiURL(raw string, allowInsecure bool) error {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return fmt.Errorf("invalid apiUrl %q: %v", raw, err)
+	}
+	if !u.IsAbs() || u.Host == "" {
+		return fmt.Errorf("apiUrl must be an absolute URL including a host, got %q", raw)
+	}
+	if u.Scheme != "https" && !(u.Scheme == "http" && allowInsecure) {
+		return fmt.Errorf("apiUrl must use https, got scheme %q; set allowInsecureURL or testMode to permit plain http", u.Scheme)
+	}
+	return nil
+}
+
+// apiPathData holds the variables available to apiPathTemplate.
+type apiPathData struct {
+	Zone string
+	FQDN string
+	Name string
+}
+
+// parseAPIPathTemplate parses raw as apiPathTemplate and renders it once
+// with empty values, so references to unknown variables fail at load time
+// rather than with the first request.
+func parseAPIPathTemplate(raw string) (*template.Template, error) {
+	tmpl, err := template.New("apiPathTemplate").Parse(raw)
+	if err != nil {
+		return nil, fmt.Errorf("invalid apiPathTemplate: %v", err)
+	}
+	if err := tmpl.Execute(io.Discard, apiPathData{}); err != nil {
+		return nil, fmt.Errorf("invalid apiPathTemplate: %v", err)
+	}
+	return tmpl, nil
+}
+
+// apiEndpoints returns the endpoints to send a request for data to: the
+// apiUrl list, with the rendered apiPathTemplate appended to each path.
+func apiEndpoints(cfg domainOffensiveDNSProviderConfig, data apiPathData) ([]string, error) {
+	if cfg.apiPath == nil {
+		return cfg.ApiURL, nil
+	}
+	var path strings.Builder
+	if err := cfg.apiPath.Execute(&path, data); err != nil {
+		return nil, fmt.Errorf("rendering apiPathTemplate: %w", err)
+	}
+	endpoints := make([]string, len(cfg.ApiURL))
+	for i, base := range cfg.ApiURL {
+		endpoint, err := url.JoinPath(base, path.String())
+		if err != nil {
+			return nil, fmt.Errorf("rendering apiPathTemplate for %s: %w", base, err)
+		}
+		endpoints[i] = endpoint
+	}
+	return endpoints, nil
+}
+
+// headerNames returns the sorted names of headers, for logging them without
+// their values.
+func headerNames(headers map[string]string) []string {
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
+
+// reservedHeaders are set by the solver or the http client and cannot be
+// overridden through requestHeaders.
+var reservedHeaders = []string{
+	"Host", "Authorization", "User-Agent", "Content-Type", "Content-Length",
+	"Transfer-Encoding", "Connection", "Accept-Encoding", testTrafficHeader,
+}
+
+// validateRequestHeaders checks that headers are well-formed and do not
+// override reserved headers.
+func validateRequestHeaders(headers map[string]string) error {
+	for name, value := range headers {
+		if name == "" || strings.ContainsAny(name, " \t\r\n:") {
+			return fmt.Errorf("requestHeaders: invalid header name %q", name)
+		}
+		if strings.ContainsAny(value, "\r\n") {
+			return fmt.Errorf("requestHeaders: value of %s must not contain line breaks", name)
+		}
+		if slices.Contains(reservedHeaders, http.CanonicalHeaderKey(name)) {
+			return fmt.Errorf("requestHeaders: %s is set by the solver and cannot be overridden", name)
+		}
+	}
+	return nil
+}
+
+// validateTokenSource checks that exactly one way of obtaining the API token
+// is configured and that any referenced secrets are complete.
+func validateTokenSource(cfg domainOffensiveDNSProviderConfig) error {
+	hasSecretRef := cfg.SecretKeyRef.Name != "" || cfg.SecretKeyRef.Key != ""
+	if cfg.TokenFile != "" && hasSecretRef {
+		return errors.New("tokenFile and secretKeyRef are mutually exclusive, set only one of them")
+	}
+	if cfg.TokenFile == "" && !hasSecretRef && len(cfg.ZoneSecretKeyRefs) == 0 {
+		return fmt.Errorf("%w: no token source configured, set secretKeyRef, tokenFile or zoneSecretKeyRefs", ErrMissingSecretKeyRef)
+	}
+	if hasSecretRef {
+		if cfg.SecretKeyRef.Name == "" {
+			return fmt.Errorf("%w: secretKeyRef.name must be set", ErrMissingSecretKeyRef)
+		}
+	}
+	for zone, ref := range cfg.ZoneSecretKeyRefs {
+		if ref.Name == "" || ref.Key == "" {
+			return fmt.Errorf("%w: zoneSecretKeyRefs[%q] must set both name and key", ErrMissingSecretKeyRef, zone)
+		}
+	}
+	if ref := cfg.AccountIDSecretKeyRef; ref != nil && (ref.Name == "" || ref.Key == "") {
+		return fmt.Errorf("%w: accountIdSecretKeyRef must set both name and key", ErrMissingSecretKeyRef)
+	}
+	if ref := cfg.ApiURLSecretKeyRef; ref != nil && (ref.Name == "" || ref.Key == "") {
+		return fmt.Errorf("%w: apiUrlSecretKeyRef must set both name and key", ErrMissingSecretKeyRef)
+	}
+	return nil
+}
+
+// loadSecrets returns the API token for the challenge and fills in the
+// settings of cfg that are read from secrets: the account ID and, if
+// apiUrlSecretKeyRef is set, the API URL.
+func (c *domainOffensiveDNSProviderSolver) loadSecrets(ctx context.Context, ch *v1alpha1.ChallengeRequest, cfg *domainOffensiveDNSProviderConfig) (string, error) {
+	token, err := c.loadToken(ctx, ch, *cfg)
+	if err != nil {
+		return "", err
+	}
+	if cfg.accountID, err = c.readAccountID(ctx, ch, *cfg); err != nil {
+		return "", err
+	}
+	if ref := cfg.ApiURLSecretKeyRef; ref != nil {
+		apiURL, err := c.secretProvider(*ref, *cfg).read(ctx, ch.ResourceNamespace, "apiUrl")
+		if err != nil {
+			return "", err
+		}
+		apiURL = strings.TrimSpace(apiURL)
+		if err := validateApiURL(apiURL, cfg.AllowInsecureURL || cfg.TestMode); err != nil {
+			return "", fmt.Errorf("apiUrlSecretKeyRef: %w", err)
+		}
+		cfg.ApiURL = endpointList{apiURL}
+	}
+	return token, nil
+}
+
+// loadToken resolves the API token for the challenge and decodes it as
+// configured by tokenEncoding. Surrounding whitespace, typically a newline
+// from `echo` or a file, is trimmed both from the stored and the decoded
+// value unless preserveTokenWhitespace is set.
+func (c *domainOffensiveDNSProviderSolver) loadToken(ctx context.Context, ch *v1alpha1.ChallengeRequest, cfg domainOffensiveDNSProviderConfig) (string, error) {
+	token, err := c.readToken(ctx, ch, cfg)
+	if err != nil {
+		return "", err
+	}
+	if !cfg.PreserveTokenWhitespace {
+		token = strings.TrimSpace(token)
+	}
+	token, err = decodeToken(token, cfg.TokenEncoding)
+	if err != nil {
+		return "", err
+	}
+	if !cfg.PreserveTokenWhitespace {
+		token = strings.TrimSpace(token)
+	}
+	return token, nil
+}
+
+// readToken reads the API token for the challenge. A zone-specific secret
+// takes precedence; otherwise the token comes from the configured token file
+// or the top-level secret in the challenge namespace.
+func (c *domainOffensiveDNSProviderSolver) readToken(ctx context.Context, ch *v1alpha1.ChallengeRequest, cfg domainOffensiveDNSProviderConfig) (string, error) {
+	return c.credentialProvider(ch, cfg).Token(ctx, ch.ResourceNamespace)
+}
+
+// readAccountID reads the account ID referenced by accountIDSecretKeyRef,
+// or returns "" if none is configured.
+func (c *domainOffensiveDNSProviderSolver) readAccountID(ctx context.Context, ch *v1alpha1.ChallengeRequest, cfg domainOffensiveDNSProviderConfig) (string, error) {
+	if cfg.AccountIDSecretKeyRef == nil {
+		return "", nil
+	}
+	return c.secretProvider(*cfg.AccountIDSecretKeyRef, cfg).read(ctx, ch.ResourceNamespace, "account ID")
+}
+
+// decodeToken decodes a token stored with the given tokenEncoding. The error
+// never includes the token.
+func decodeToken(token, encoding string) (string, error) {
+	if encoding != tokenEncodingBase64 {
+		return token, nil
+	}
+	decoded, err := base64.StdEncoding.DecodeString(token)
+	if err != nil {
+		return "", fmt.Errorf("token is not valid base64 as required by tokenEncoding %q: %v", tokenEncodingBase64, err)
+	}
+	return string(decoded), nil
+}
+
+// invalidateToken drops the cached secret the token for the challenge was
+// read from, so a rotated token is picked up on the next attempt.
+func (c *domainOffensiveDNSProviderSolver) invalidateToken(ch *v1alpha1.ChallengeRequest, cfg domainOffensiveDNSProviderConfig) {
+	if ref, ok := tokenSecretRef(ch, cfg); ok {
+		c.secrets.invalidate(secretCacheKey(ch.ResourceNamespace, ref.Name))
+	}
+}
+
+// tokenSecretRef returns the secret the token for the challenge is read
+// from, or false if it is read from the token file instead.
+func tokenSecretRef(ch *v1alpha1.ChallengeRequest, cfg domainOffensiveDNSProviderConfig) (corev1.SecretKeySelector, bool) {
+	if ref, ok := secretKeyRefForZone(cfg.ZoneSecretKeyRefs, cfg.zone(ch)); ok {
+		return ref, true
+	}
+	if cfg.TokenFile != "" {
+		return corev1.SecretKeySelector{}, false
+	}
+	return cfg.SecretKeyRef, true
+}
+
+// secretKeyRefForZone returns the entry of refs whose zone suffix is the
+// longest match for zone.
+func secretKeyRefForZone(refs map[string]corev1.SecretKeySelector, zone string) (corev1.SecretKeySelector, bool) {
+	zone = normalizeDomain(zone)
+
+	var best corev1.SecretKeySelector
+	bestLen := -1
+	for suffix, ref := range refs {
+		s := normalizeDomain(suffix)
+		if zone != s && !strings.HasSuffix(zone, "."+s) {
+			continue
+		}
+		if len(s) > bestLen {
+			best, bestLen = ref, len(s)
+		}
+	}
+	return best, bestLen >= 0
+}
+
+// normalizeDomain lowercases a domain name and strips its trailing dot.
+func normalizeDomain(name string) string {
+	return strings.ToLower(strings.TrimSuffix(name, "."))
+}
+
 func stringFromSecretData(secretData map[string][]byte, key string) (string, error) {
 	data, ok := secretData[key]
 	if !ok {
-		return "", fmt.Errorf("key %q not found in secret data", key)
+		return "", fmt.Errorf("%w: key %q not found in secret data", ErrSecretNotFound, key)
 	}
 	return string(data), nil
 }
 
-func presentRecord(ch *v1alpha1.ChallengeRequest, apiUrl, token string) error {
-    return callDoApi(ch, apiUrl, token, false)
+func stringFromFile(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("unable to read token file %q: %v", path, err)
+	}
+	return string(data), nil
+}
+
+// recordAction is the change callDoApi applies to the TXT record set at the
+// challenge FQDN.
+type recordAction int
+
+const (
+	// actionPresent adds the challenge key to the record set.
+	actionPresent recordAction = iota
+	// actionDelete removes only the challenge key from the record set.
+	actionDelete
+	// actionClear removes every value from the record set by sending the
+	// delete action without a value.
+	actionClear
+)
+
+// presentRecord adds the challenge key. In replace mode the record set is
+// cleared first, so afterwards it holds exactly the challenge key. The ID the
+// API returns for the new record, if any, is kept in ids for deleteRecord.
+//
+// Presenting a record that already exists is not an error, so Present can be
+// repeated safely, e.g. after a restart of the webhook.
+//
+// The API takes a single record per request and offers no batch operation,
+// so the names of a SAN certificate are presented with one request each.
+// API_RATE_LIMIT is the way to smooth out such bursts.
+func presentRecord(ctx context.Context, client *http.Client, ch *v1alpha1.ChallengeRequest, cfg domainOffensiveDNSProviderConfig, token string, ids *recordIDStore) error {
+	if cfg.ReplaceMode {
+		if _, err := callAPI(ctx, client, ch, cfg, token, actionClear, ""); ignoreNotFound(err) != nil {
+			return err
+		}
+	}
+	id, err := callAPI(ctx, client, ch, cfg, token, actionPresent, "")
+	if isAlreadyExists(err) {
+		klog.Infof("acme txt record %v already present: %v", ch.ResolvedFQDN, err)
+		err = nil
+	}
+	if err == nil {
+		ids.put(ch, id)
+	}
+	return err
+}
+
+// deleteRecord removes the challenge key, or in replace mode the whole
+// record set. A record whose ID is known from presentRecord is deleted by
+// ID, any other by value.
+//
+// Deleting a record that does not exist is not an error.
+func deleteRecord(ctx context.Context, client *http.Client, ch *v1alpha1.ChallengeRequest, cfg domainOffensiveDNSProviderConfig, token string, ids *recordIDStore) error {
+	action := actionDelete
+	if cfg.ReplaceMode {
+		action = actionClear
+	}
+	_, err := callAPI(ctx, client, ch, cfg, token, action, ids.get(ch.ResolvedFQDN, ch.Key))
+	if isNotFound(err) {
+		klog.Infof("acme txt record %v already gone: %v", ch.ResolvedFQDN, err)
+		err = nil
+	}
+	if err == nil {
+		ids.remove(ch.ResolvedFQDN, ch.Key)
+	}
+	return err
+}
+
+// ignoreNotFound returns nil if err reports a missing record.
+func ignoreNotFound(err error) error {
+	if isNotFound(err) {
+		return nil
+	}
+	return err
 }
 
-func deleteRecord(ch *v1alpha1.ChallengeRequest, apiUrl, token string) error {
-    return callDoApi(ch, apiUrl, token, true)
+// callDoApi applies action to the TXT record set at the challenge FQDN and
+// returns the ID of a created record if the API reports one. A non-empty
+// recordID makes a delete target that record instead of the value. It maps
+// the challenge to a record name and value and sends the change through a
+// doAPIClient.
+//
+// The default additive actions leave other values at the same FQDN alone, so
+// concurrent challenges for one name (e.g. a wildcard and its apex) do not
+// interfere. actionClear, used by replace mode, drops all values: a second
+// challenge presented for the same FQDN replaces the first one, and cleaning
+// up either removes both. Replace mode is only safe when a single challenge
+// per FQDN is in flight; the solver falls back to the additive actions for
+// overlapping challenges it knows of, see sharedFQDNConfig.
+func callDoApi(ctx context.Context, client *http.Client, ch *v1alpha1.ChallengeRequest, cfg domainOffensiveDNSProviderConfig, token string, action recordAction, recordID string) (createdID string, err error) {
+	var endpoint string
+	ctx, finish := observeAPICall(ctx, ch, cfg, token, action)
+	defer func() { err = finish(endpoint, err) }()
+
+	rec, err := resolveChallengeRecord(ctx, ch, cfg)
+	if err != nil {
+		return "", err
+	}
+	endpoints, err := apiEndpoints(cfg, apiPathData{
+		Zone: normalizeDomain(cfg.zone(ch)),
+		FQDN: normalizeDomain(rec.fqdn),
+		Name: rec.name,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	api := newDoAPIClient(client, endpoints[0], endpoints[1:], token, cfg, ch)
+	defer func() { endpoint = api.endpoint }()
+	switch {
+	case action == actionPresent:
+		return api.PresentTXT(ctx, rec.name, rec.value)
+	case action == actionDelete && recordID != "":
+		return "", api.DeleteTXTByID(ctx, rec.name, recordID, rec.value)
+	case action == actionDelete:
+		return "", api.DeleteTXT(ctx, rec.name, rec.value)
+	default:
+		return "", api.ClearTXT(ctx, rec.name)
+	}
+}
+
+// handleMissingSuccess applies missingSuccess to a successful HTTP response
+// whose body has neither a success nor a status field.
+func handleMissingSuccess(ch *v1alpha1.ChallengeRequest, cfg domainOffensiveDNSProviderConfig, resp *apiResponse, token string) error {
+	switch cfg.MissingSuccess {
+	case missingSuccessLenient:
+		return nil
+	case missingSuccessWarn:
+		klog.Warningf("unrecognized api response format for %v, treating status %d as success: %s",
+			ch.ResolvedFQDN, resp.statusCode, redactToken(string(resp.body), token))
+		return nil
+	}
+	return fmt.Errorf("%w: api response has no success field (body=%s); set missingSuccess to lenient or warn for gateways that omit it",
+		ErrAPIFailure, string(resp.body))
 }
 
-func callDoApi(ch *v1alpha1.ChallengeRequest, apiUrl string, token string, delete bool) (error) {
+// renamableParams are the parameters of the letsencrypt endpoint, which
+// paramNames may rename.
+var renamableParams = []string{"token", "account_id", "domain", "value", "record_id", "type", "ttl", "action"}
+
+// renameParams returns q with the parameters renamed as given by names.
+func renameParams(q url.Values, names map[string]string) url.Values {
+	if len(names) == 0 {
+		return q
+	}
+	renamed := url.Values{}
+	for k, v := range q {
+		if name, ok := names[k]; ok {
+			k = name
+		}
+		renamed[k] = v
+	}
+	return renamed
+}
+
+// validateParamNames checks that names only renames renamableParams, to
+// distinct non-empty names.
+func validateParamNames(names map[string]string) error {
+	seen := map[string]string{}
+	for param, name := range names {
+		if !slices.Contains(renamableParams, param) {
+			return fmt.Errorf("paramNames: %q cannot be renamed, only %v", param, renamableParams)
+		}
+		if name == "" {
+			return fmt.Errorf("paramNames: name for %q must not be empty", param)
+		}
+		if other, ok := seen[name]; ok {
+			return fmt.Errorf("paramNames: %q and %q are both renamed to %q", other, param, name)
+		}
+		seen[name] = param
+	}
+	return nil
+}
+
+// observeAPICall starts tracking an API call for action. The returned
+// function ends the call's span, records its metrics and operation log and
+// returns err with token redacted; it is meant to be deferred.
+func observeAPICall(ctx context.Context, ch *v1alpha1.ChallengeRequest, cfg domainOffensiveDNSProviderConfig, token string, action recordAction) (context.Context, func(endpoint string, err error) error) {
+	operation := operationName(action)
+	start := time.Now()
+	done := trackInFlight(operation)
+	ctx, span := startSpan(ctx, "api "+operation, ch)
+	return ctx, func(endpoint string, err error) error {
+		defer done()
+		// the token can end up in errors, e.g. in the request URL of a
+		// *url.Error, so it is redacted from everything returned, as is an
+		// API URL read from a secret along with its host
+		err = redactSecretURLError(redactError(err, token), secretURL(cfg))
+		endpoint = redactSecretURL(endpoint, secretURL(cfg))
+
+		observeAPIResult(operation, err)
+		if err != nil {
+			logEvent(operationEvent{Message: "api request failed", Operation: operation, Challenge: ch, Endpoint: endpoint, Status: resultAPIError, Start: start, Err: err})
+		} else if !cfg.DryRun {
+			logEvent(operationEvent{Message: apiResultMessages[action], Operation: operation, Challenge: ch, Endpoint: endpoint, Status: resultSuccess, Start: start})
+		}
+		span.SetAttributes(attribute.String("endpoint", endpoint))
+		if err != nil {
+			endSpan(span, ch, resultAPIError, err)
+		} else {
+			endSpan(span, ch, resultSuccess, nil)
+		}
+		return err
+	}
+}
+
+// challengeRecord is the record a challenge is solved with, as sent to the
+// API.
+type challengeRecord struct {
+	// fqdn is the challenge FQDN, or its CNAME target with followCNAME.
+	fqdn string
+	// name is fqdn in recordNameFormat with recordNamePrefix applied.
+	name string
+	// value is the challenge key, or testValue, in valueEncoding.
+	value string
+	// served is value as nameservers serve the record, for checking its
+	// propagation and deletion: without the quotes of valueEncoding quoted
+	// and chunkValue, which the gateway unwraps, see ValueEncoding.
+	served string
+}
+
+// resolveChallengeRecord maps ch to the record sent to the API.
+func resolveChallengeRecord(ctx context.Context, ch *v1alpha1.ChallengeRequest, cfg domainOffensiveDNSProviderConfig) (challengeRecord, error) {
 	fqdn := ch.ResolvedFQDN
-	fqdn = strings.TrimSuffix(fqdn, ".")
-	val := ch.Key
+	if cfg.FollowCNAME {
+		target, err := followCNAME(ctx, fqdn, cfg.resolvers())
+		if err != nil {
+			return challengeRecord{}, fmt.Errorf("unable to resolve CNAME for %s: %w", fqdn, err)
+		}
+		fqdn = target
+	}
+	name, err := recordName(fqdn, cfg.zone(ch), cfg.RecordNameFormat)
+	if err != nil {
+		return challengeRecord{}, err
+	}
+	if name, err = replaceChallengeLabel(name, cfg.RecordNamePrefix); err != nil {
+		return challengeRecord{}, err
+	}
+	key := ch.Key
+	if cfg.TestMode && cfg.TestValue != "" {
+		klog.Infof("test mode: sending test value instead of the challenge key for %v", ch.ResolvedFQDN)
+		key = cfg.TestValue
+	}
+	value := encodeValue(key, cfg.ValueEncoding)
+	served := value
+	if cfg.ValueEncoding == valueEncodingQuoted {
+		served = key
+	}
+	if cfg.ChunkValue {
+		value = chunkValue(value)
+	}
+	return challengeRecord{fqdn: fqdn, name: name, value: value, served: served}, nil
+}
+
+// apiHeader returns the headers of an API request and adds the token to
+// either the headers or q, depending on authMode, along with the account ID.
+func apiHeader(cfg domainOffensiveDNSProviderConfig, token string, q url.Values) http.Header {
+	header := http.Header{}
+	for k, v := range cfg.RequestHeaders {
+		header.Set(k, v)
+	}
+	header.Set("User-Agent", cfg.UserAgent)
+	if cfg.TestMode {
+		header.Set(testTrafficHeader, "true")
+	}
+	if cfg.AuthMode == authModeHeader {
+		header.Set("Authorization", "Bearer "+token)
+	} else {
+		q.Set("token", token)
+	}
+	if cfg.accountID != "" {
+		q.Set("account_id", cfg.accountID)
+	}
+	return header
+}
+
+// sendWithRetries sends r, falling back across endpoints, and retries it
+// with backoff while it fails with a network error or a transient status.
+// Redirects are refused, as the client does not follow them. Errors match
+// ErrAPIFailure unless the context ended.
+func sendWithRetries(ctx context.Context, client *http.Client, ch *v1alpha1.ChallengeRequest, cfg domainOffensiveDNSProviderConfig, r apiRequest, endpoints []string, operation string) (*apiResponse, string, error) {
+	backoff := newBackoffStrategy(cfg.BackoffStrategy, cfg.RetryBaseDelay.Duration)
+	for attempt := 1; ; attempt++ {
+		start := time.Now()
+		resp, endpoint, err := doWithFallback(ctx, client, r, endpoints, cfg.HTTPTimeout.Duration, operation)
+		// each attempt is timed on its own, so the backoff between
+		// attempts does not count towards slowCallThreshold
+		if threshold := cfg.SlowCallThreshold.Duration; time.Since(start) > threshold {
+			status := resultSuccess
+			if err != nil || isRetryableStatus(resp.statusCode) {
+				status = resultAPIError
+			}
+			logEvent(operationEvent{Message: fmt.Sprintf("slow api call, took longer than %v", threshold), Operation: operation, Challenge: ch,
+				Endpoint: redactSecretURL(endpoint, r.secretURL), Status: status, Start: start, Warning: true})
+		}
+		if err == nil && !isRetryableStatus(resp.statusCode) {
+			if resp.statusCode >= 300 && resp.statusCode < 400 {
+				return nil, endpoint, fmt.Errorf("%w: api status %d redirects to %q; update apiUrl to the new location",
+					ErrAPIFailure, resp.statusCode, resp.header.Get("Location"))
+			}
+			return resp, endpoint, nil
+		}
+		if err == nil {
+			err = fmt.Errorf("api status %d: %s", resp.statusCode, string(resp.body))
+		}
+		if attempt >= cfg.RetryMaxAttempts || ctx.Err() != nil || errors.Is(err, ErrCircuitOpen) {
+			return nil, endpoint, fmt.Errorf("%w: %w", ErrAPIFailure, err)
+		}
+
+		delay := backoff.NextDelay(attempt)
+		if resp != nil && resp.statusCode == http.StatusTooManyRequests {
+			if d, ok := parseRetryAfter(resp.header.Get("Retry-After"), time.Now()); ok {
+				delay = min(d, cfg.RetryAfterMax.Duration)
+			}
+		}
+		klog.Warningf("api request for %v failed (attempt %d/%d), retrying in %v: %v",
+			ch.ResolvedFQDN, attempt, cfg.RetryMaxAttempts, delay, r.redact(err))
+		if err := sleepContext(ctx, delay); err != nil {
+			return nil, endpoint, err
+		}
+	}
+}
+
+// apiResult is what a successful API response reports.
+type apiResult struct {
+	// known is false if the response had none of the known shapes.
+	known bool
+	// recordID identifies the created record, if the API returned one.
+	recordID string
+}
+
+// parseAPIResponse interprets the JSON body of a successful HTTP response.
+// Two shapes are known: the current {"success": bool, "error": ...,
+// "message": ...}, and {"status": "ok"|"error", "error": {"code": ...,
+// "message": ...}} should the API move to a status field. Either may carry
+// a record_id. Any other JSON object is reported as unknown without an
+// error, leaving the decision to missingSuccess.
+func parseAPIResponse(body []byte) (apiResult, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(body, &fields); err != nil {
+		return apiResult{}, fmt.Errorf("%w: error decoding api response: %w (body=%s)", ErrAPIFailure, err, string(body))
+	}
+
+	if raw, ok := fields["success"]; ok {
+		var success bool
+		if err := json.Unmarshal(raw, &success); err != nil {
+			return apiResult{known: true}, fmt.Errorf("%w: error decoding api response: success: %w (body=%s)", ErrAPIFailure, err, string(body))
+		}
+		if !success {
+			return apiResult{known: true}, &apiError{
+				Code:    rawString(fields["error"]),
+				Message: rawString(fields["message"]),
+				Body:    string(body),
+			}
+		}
+		return apiResult{known: true, recordID: rawString(fields["record_id"])}, nil
+	}
+
+	if raw, ok := fields["status"]; ok {
+		var status string
+		if err := json.Unmarshal(raw, &status); err == nil {
+			switch strings.ToLower(status) {
+			case "ok", "success":
+				return apiResult{known: true, recordID: rawString(fields["record_id"])}, nil
+			case "error":
+				e := &apiError{Body: string(body)}
+				var detail struct {
+					Code    json.RawMessage `json:"code"`
+					Message json.RawMessage `json:"message"`
+				}
+				if err := json.Unmarshal(fields["error"], &detail); err == nil {
+					e.Code, e.Message = rawString(detail.Code), rawString(detail.Message)
+				} else {
+					e.Code = rawString(fields["error"])
+				}
+				if e.Message == "" {
+					e.Message = rawString(fields["message"])
+				}
+				return apiResult{known: true}, e
+			}
+		}
+	}
+
+	return apiResult{}, nil
+}
+
+// apiResultMessages are the operation log messages of successful API calls.
+var apiResultMessages = map[recordAction]string{
+	actionPresent: "Presented acme txt record",
+	actionDelete:  "Cleaned up acme txt record",
+	actionClear:   "Cleared all acme txt records",
+}
+
+// apiError is returned when the API answers with success=false. Code and
+// Message carry the structured error details of the response, if any.
+type apiError struct {
+	Code    string
+	Message string
+	Body    string
+}
+
+func (e *apiError) Error() string {
+	var msg string
+	switch {
+	case e.Code != "" && e.Message != "":
+		msg = fmt.Sprintf("api returned success=false: error=%q message=%q", e.Code, e.Message)
+	case e.Code != "":
+		msg = fmt.Sprintf("api returned success=false: error=%q", e.Code)
+	case e.Message != "":
+		msg = fmt.Sprintf("api returned success=false: message=%q", e.Message)
+	default:
+		msg = fmt.Sprintf("api returned success=false: %s", e.Body)
+	}
+	switch {
+	case e.invalidToken():
+		msg += "; the token was rejected, check the token in the referenced secret"
+	case e.domainNotManaged():
+		msg += "; the token may not manage this domain, check that the issuer references the secret for this zone"
+	}
+	return msg
+}
+
+// Is makes every apiError match ErrAPIFailure, and ErrInvalidToken or
+// ErrDomainNotManaged if its error fields say so.
+func (e *apiError) Is(target error) bool {
+	switch target {
+	case ErrAPIFailure:
+		return true
+	case ErrInvalidToken:
+		return e.invalidToken()
+	case ErrDomainNotManaged:
+		return e.domainNotManaged()
+	}
+	return false
+}
+
+// invalidToken reports whether the API rejected the token itself.
+func (e *apiError) invalidToken() bool {
+	return e.matches(invalidTokenPhrases)
+}
+
+// domainNotManaged reports whether the API accepted the token but refused
+// the domain. Token errors take precedence, as some messages name both.
+func (e *apiError) domainNotManaged() bool {
+	return !e.invalidToken() && e.matches(domainNotManagedPhrases)
+}
+
+// matches reports whether the error fields contain any of phrases, ignoring
+// case.
+func (e *apiError) matches(phrases []string) bool {
+	text := strings.ToLower(e.Code + " " + e.Message)
+	for _, p := range phrases {
+		if strings.Contains(text, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// The phrases are matched case-insensitively against the error fields of an
+// API response to classify it. Generic refusals such as "unauthorized" or
+// "forbidden" say neither whether the token or the domain was refused, so
+// they stay unclassified.
+var (
+	alreadyExistsPhrases    = []string{"already exist", "duplicate"}
+	notFoundPhrases         = []string{"record not found", "record does not exist", "no such record", "unknown record"}
+	invalidTokenPhrases     = []string{"invalid token", "token invalid", "unknown token", "token not found", "wrong token", "token expired"}
+	domainNotManagedPhrases = []string{"not managed", "not your domain", "domain not allowed", "not authorized for domain", "not allowed for domain", "not permitted for domain"}
+)
+
+// isAlreadyExists reports whether err is an API error about a record that
+// already exists.
+func isAlreadyExists(err error) bool {
+	return apiErrorMatches(err, alreadyExistsPhrases)
+}
+
+// isNotFound reports whether err is an API error about a missing record. An
+// unknown token or a domain the token does not manage is not a missing
+// record, so the phrases name the record and a bare "not found", as in
+// "domain not found", does not match.
+func isNotFound(err error) bool {
+	return apiErrorMatches(err, notFoundPhrases) && !errors.Is(err, ErrInvalidToken) && !errors.Is(err, ErrDomainNotManaged)
+}
+
+func apiErrorMatches(err error, phrases []string) bool {
+	var apiErr *apiError
+	return errors.As(err, &apiErr) && apiErr.matches(phrases)
+}
+
+// rawString renders a JSON value as text, unquoting it if it is a string.
+func rawString(raw json.RawMessage) string {
+	if len(raw) == 0 || string(raw) == "null" {
+		return ""
+	}
+	var s string
+	if err := json.Unmarshal(raw, &s); err == nil {
+		return s
+	}
+	return string(raw)
+}
 
-	q := url.Values{}
-	q.Set("token", token)
-	q.Set("domain", fqdn)
-	q.Set("value", val)
-	if delete { q.Set("action", "delete") }
-	uri := apiUrl + "?" + q.Encode()
+// apiRequest describes a single call to the API.
+type apiRequest struct {
+	method string
+	url    string
+	params url.Values
+	header http.Header
+	// token is the credential carried in params or header. It is only used
+	// to keep it out of debug logs.
+	token string
+	// secretURL is the API URL read from apiUrlSecretKeyRef, if any, which
+	// is kept out of logs like token.
+	secretURL string
+	// maxBodySize is the largest response body that is read.
+	maxBodySize int64
+	// body, if set, is sent as a JSON request body. params then always go
+	// into the query string, whatever the method.
+	body []byte
+}
+
+// redact hides the token and the secret API URL, including its host, in err.
+func (r apiRequest) redact(err error) error {
+	return redactSecretURLError(redactError(err, r.token), r.secretURL)
+}
+
+// String renders the request for debug logs with the token redacted from
+// the parameters and headers, and the secret API URL from the URL.
+func (r apiRequest) String() string {
+	r.url = redactSecretURL(r.url, r.secretURL)
+	params := url.Values{}
+	for k, v := range r.params {
+		// paramNames may have renamed the token parameter
+		if k == "token" || (r.token != "" && slices.Contains(v, r.token)) {
+			v = []string{redactedPlaceholder}
+		}
+		params[k] = v
+	}
+	// custom request headers may carry gateway keys, so only the headers
+	// known to be harmless are shown
+	header := http.Header{}
+	for k, v := range r.header {
+		if k != "User-Agent" && k != testTrafficHeader {
+			v = []string{redactedPlaceholder}
+		}
+		header[k] = v
+	}
 
-	resp, err := http.Get(uri) // #nosec G107
+	if r.method == http.MethodPost && r.body == nil {
+		return fmt.Sprintf("%s %s header=%v body=%s", r.method, r.url, header, params.Encode())
+	}
+	u, err := withQuery(r.url, params)
 	if err != nil {
-		return fmt.Errorf("http get: %w", err)
+		u = r.url
 	}
-	defer resp.Body.Close()
+	if r.body != nil {
+		return fmt.Sprintf("%s %s header=%v body=%s", r.method, u, header, r.body)
+	}
+	return fmt.Sprintf("%s %s header=%v", r.method, u, header)
+}
 
-	body, err := io.ReadAll(resp.Body)
+// withQuery adds params to the query of base, keeping any path and query
+// parameters base already has. Parameters in params replace those of the
+// same name in base.
+func withQuery(base string, params url.Values) (string, error) {
+	u, err := url.Parse(base)
 	if err != nil {
-		return fmt.Errorf("error reading response body: %w", err)
+		return "", err
 	}
+	q := u.Query()
+	for k, v := range params {
+		q[k] = v
+	}
+	u.RawQuery = q.Encode()
+	return u.String(), nil
+}
 
-	if resp.StatusCode != 200 {
-		return fmt.Errorf("api status %d: %s", resp.StatusCode, string(body))
+// encodeValue returns the value parameter for key in the given
+// valueEncoding. Only the quotes are unwrapped by the gateway; a base64
+// value is served as sent.
+func encodeValue(key, encoding string) string {
+	switch encoding {
+	case valueEncodingQuoted:
+		return `"` + key + `"`
+	case valueEncodingBase64:
+		return base64.StdEncoding.EncodeToString([]byte(key))
 	}
+	return key
+}
 
-	var jr struct {
-		Success bool `json:"success"`
+// decodeValue returns the key that encodeValue turned into value, which may
+// be quoted as sent or unquoted as served. ok is false if value is not
+// valid in the encoding.
+func decodeValue(value, encoding string) (key string, ok bool) {
+	switch encoding {
+	case valueEncodingQuoted:
+		return strings.TrimSuffix(strings.TrimPrefix(value, `"`), `"`), true
+	case valueEncodingBase64:
+		b, err := base64.StdEncoding.DecodeString(value)
+		if err != nil {
+			return "", false
+		}
+		return string(b), true
 	}
-	if err := json.Unmarshal(body, &jr); err != nil {
-		return fmt.Errorf("error decoding api response: %w (body=%s)", err, string(body))
+	return value, true
+}
+
+// maxTXTStringLength is the longest single string of a TXT record.
+const maxTXTStringLength = 255
+
+// chunkValue splits a value longer than maxTXTStringLength into strings of
+// that length, each quoted and separated by a space. Shorter values are
+// returned unchanged.
+func chunkValue(value string) string {
+	if len(value) <= maxTXTStringLength {
+		return value
 	}
-	if !jr.Success {
-		return fmt.Errorf("api returned success=false: %s", string(body))
+	var chunks []string
+	for len(value) > 0 {
+		n := min(len(value), maxTXTStringLength)
+		chunks = append(chunks, strconv.Quote(value[:n]))
+		value = value[n:]
 	}
+	return strings.Join(chunks, " ")
+}
 
-	if !delete {
-		klog.Infof("Presented acme txt record %v", ch.ResolvedFQDN)
-	} else {
-		klog.Infof("Cleaned up acme txt record %v", ch.ResolvedFQDN)
+// requestMapping returns key/value pairs relating cert-manager's view of ch
+// to the record parameters in q, for debugging delegation issues. The token
+// is never included.
+func requestMapping(operation string, ch *v1alpha1.ChallengeRequest, q url.Values) []any {
+	kv := []any{
+		"operation", operation,
+		"dnsName", ch.DNSName,
+		"resolvedZone", ch.ResolvedZone,
+		"resolvedFQDN", ch.ResolvedFQDN,
+	}
+	for _, p := range renamableParams {
+		// credentials stay out of the log
+		if p != "token" && p != "account_id" && q.Has(p) {
+			kv = append(kv, p, q.Get(p))
+		}
 	}
+	return kv
+}
 
-	return nil
+// apiResponse holds the parts of an API response needed after the
+// connection has been closed.
+type apiResponse struct {
+	statusCode int
+	header     http.Header
+	body       []byte
+}
+
+// doWithFallback sends the request to each endpoint in turn until one
+// answers without a connection error or 5xx status. It returns the last
+// response or error along with the endpoint that produced it.
+func doWithFallback(ctx context.Context, client *http.Client, r apiRequest, endpoints []string, timeout time.Duration, operation string) (*apiResponse, string, error) {
+	var resp *apiResponse
+	var endpoint string
+	var err error
+	for i, e := range endpoints {
+		endpoint = e
+		r.url = e
+		start := time.Now()
+		resp, err = doApiRequest(ctx, client, r, timeout)
+		observeAPIRequest(operation, start)
+		if err == nil && resp.statusCode < http.StatusInternalServerError {
+			return resp, endpoint, nil
+		}
+		if ctx.Err() != nil {
+			break
+		}
+		if i < len(endpoints)-1 {
+			failure := r.redact(err)
+			if failure == nil {
+				failure = fmt.Errorf("api status %d", resp.statusCode)
+			}
+			klog.Warningf("api endpoint %s failed, trying %s: %v",
+				redactSecretURL(e, r.secretURL), redactSecretURL(endpoints[i+1], r.secretURL), failure)
+		}
+	}
+	return resp, endpoint, err
+}
+
+// doApiRequest performs a single request against the API and reads the full
+// response body, decompressing it if it is gzip encoded. With POST and no
+// JSON body the parameters are sent as a form body, otherwise they are
+// encoded into the query string. The timeout covers the whole
+// exchange, including reading the body.
+func doApiRequest(ctx context.Context, client *http.Client, r apiRequest, timeout time.Duration) (*apiResponse, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	if r.secretURL != "" {
+		ctx = withSecretHost(ctx)
+	}
+
+	var req *http.Request
+	var err error
+	switch {
+	case r.body != nil:
+		var u string
+		if u, err = withQuery(r.url, r.params); err == nil {
+			req, err = http.NewRequestWithContext(ctx, r.method, u, bytes.NewReader(r.body))
+		}
+	case r.method == http.MethodPost:
+		req, err = http.NewRequestWithContext(ctx, http.MethodPost, r.url, strings.NewReader(r.params.Encode()))
+	default:
+		var u string
+		if u, err = withQuery(r.url, r.params); err == nil {
+			req, err = http.NewRequestWithContext(ctx, r.method, u, nil) // #nosec G107
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("building request: %w", err)
+	}
+	for k, v := range r.header {
+		req.Header[k] = v
+	}
+	switch {
+	case r.body != nil:
+		req.Header.Set("Content-Type", "application/json")
+	case r.method == http.MethodPost:
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	// Asking for gzip explicitly turns off the transparent decompression
+	// of http.Transport, so responses are decompressed below. This also
+	// covers proxies that compress regardless of the request.
+	req.Header.Set("Accept-Encoding", "gzip")
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(req.Header))
+
+	klog.V(4).Infof("api request: %v", r)
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("http %s: %w", strings.ToLower(req.Method), err)
+	}
+	defer resp.Body.Close()
+
+	var bodyReader io.Reader = resp.Body
+	if strings.EqualFold(resp.Header.Get("Content-Encoding"), "gzip") {
+		zr, err := gzip.NewReader(resp.Body)
+		if err != nil {
+			return nil, fmt.Errorf("error decompressing response body: %w", err)
+		}
+		defer zr.Close()
+		bodyReader = zr
+	}
+
+	// the limit applies after decompression, so small compressed bodies
+	// cannot expand without bound
+	body, err := io.ReadAll(io.LimitReader(bodyReader, r.maxBodySize+1))
+	if err != nil {
+		return nil, fmt.Errorf("error reading response body: %w", err)
+	}
+	if int64(len(body)) > r.maxBodySize {
+		return nil, fmt.Errorf("response body exceeds maxResponseBodySize of %d bytes", r.maxBodySize)
+	}
+	if klog.V(4).Enabled() {
+		klog.Infof("api response: status=%d body=%s", resp.StatusCode, redactToken(string(body), r.token))
+	}
+
+	return &apiResponse{statusCode: resp.StatusCode, header: resp.Header, body: body}, nil
+}
+
+// isRetryableStatus reports whether an HTTP status indicates a transient
+// failure that is worth retrying.
+func isRetryableStatus(code int) bool {
+	switch code {
+	case http.StatusTooManyRequests,
+		http.StatusInternalServerError,
+		http.StatusBadGateway,
+		http.StatusServiceUnavailable,
+		http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// maxRetryAfterSeconds bounds the seconds taken from a Retry-After header,
+// so converting them to a duration cannot overflow.
+const maxRetryAfterSeconds = 24 * 60 * 60
+
+// parseRetryAfter interprets a Retry-After header value, which is either a
+// number of seconds or an HTTP date, relative to now. It reports false if
+// the value is absent or cannot be parsed.
+func parseRetryAfter(v string, now time.Time) (time.Duration, bool) {
+	v = strings.TrimSpace(v)
+	if v == "" {
+		return 0, false
+	}
+	if secs, err := strconv.Atoi(v); err == nil {
+		if secs < 0 {
+			return 0, false
+		}
+		return time.Duration(min(secs, maxRetryAfterSeconds)) * time.Second, true
+	}
+	t, err := http.ParseTime(v)
+	if err != nil {
+		return 0, false
+	}
+	return max(t.Sub(now), 0), true
+}
+
+// sleepContext waits for d, returning early with the context's error if it
+// is cancelled first.
+func sleepContext(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
 }
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"k8s.io/klog/v2"
+)
+
+// defaultMetricsPort is used when METRICS_PORT is not set.
+const defaultMetricsPort = "9402"
+
+// Label values for the operation label of the solver metrics.
+const (
+	operationPresent = "present"
+	operationCleanup = "cleanup"
+)
+
+// Label values for the result label of operationsTotal and apiRequestsTotal.
+// Failures to read the token are counted apart from API failures, as they
+// point at RBAC or secret misconfiguration rather than at the API.
+const (
+	resultSuccess     = "success"
+	resultAPIError    = "api_error"
+	resultSecretError = "secret_error"
+)
+
+var (
+	// metricsRegistry is kept separate from the default registry so only the
+	// solver's own metrics are exposed.
+	metricsRegistry = prometheus.NewRegistry()
+
+	operationsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "domain_offensive_webhook",
+		Name:      "operations_total",
+		Help:      "Number of Present and CleanUp calls, by result: success, api_error, secret_error, config_error or propagation_error.",
+	}, []string{"operation", "result"})
+
+	apiRequestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "domain_offensive_webhook",
+		Name:      "api_requests_total",
+		Help:      "Number of present and cleanup calls to the do.de API, including the record set clears of replaceMode and orphan deletes, by result: success or api_error.",
+	}, []string{"operation", "result"})
+
+	apiRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "domain_offensive_webhook",
+		Name:      "api_request_duration_seconds",
+		Help:      "Latency of single requests to the do.de API.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"operation"})
+
+	apiRequestsInFlight = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "domain_offensive_webhook",
+		Name:      "api_requests_in_flight",
+		Help:      "Number of present and cleanup calls to the do.de API in progress, including retries.",
+	}, []string{"operation"})
+
+	apiCircuitOpen = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "domain_offensive_webhook",
+		Name:      "api_circuit_open",
+		Help:      "Whether the circuit breaker for an API host is open (1) and requests to it fail fast.",
+	}, []string{"host"})
+)
+
+func init() {
+	metricsRegistry.MustRegister(operationsTotal, apiRequestsTotal, apiRequestDuration, apiRequestsInFlight, apiCircuitOpen)
+}
+
+// operationName returns the operation label value for a record action.
+func operationName(action recordAction) string {
+	if action == actionPresent {
+		return operationPresent
+	}
+	return operationCleanup
+}
+
+// observeOperation records the result of a Present or CleanUp call, which
+// is the status of its log event.
+func observeOperation(operation, status string) {
+	operationsTotal.WithLabelValues(operation, status).Inc()
+}
+
+// observeAPIResult records the result of a present or cleanup call to the
+// API.
+func observeAPIResult(operation string, err error) {
+	result := resultSuccess
+	if err != nil {
+		result = resultAPIError
+	}
+	apiRequestsTotal.WithLabelValues(operation, result).Inc()
+}
+
+// trackInFlight counts an API call for operation as in flight until the
+// returned function is called.
+func trackInFlight(operation string) (done func()) {
+	g := apiRequestsInFlight.WithLabelValues(operation)
+	g.Inc()
+	return g.Dec
+}
+
+// observeAPIRequest records the latency of a single API request.
+func observeAPIRequest(operation string, start time.Time) {
+	apiRequestDuration.WithLabelValues(operation).Observe(time.Since(start).Seconds())
+}
+
+// serveMetrics exposes the solver metrics on /metrics at the port given by
+// the METRICS_PORT environment variable. It only returns on failure.
+func serveMetrics() {
+	port := os.Getenv("METRICS_PORT")
+	if port == "" {
+		port = defaultMetricsPort
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(metricsRegistry, promhttp.HandlerOpts{}))
+	srv := &http.Server{
+		Addr:              net.JoinHostPort("", port),
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	klog.Infof("serving metrics on %s", srv.Addr)
+	if err := srv.ListenAndServe(); err != nil {
+		klog.Errorf("metrics server stopped: %v", err)
+	}
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/cert-manager/cert-manager/pkg/acme/webhook/apis/acme/v1alpha1"
+	"k8s.io/klog/v2"
+)
+
+// acmeValuePattern matches DNS01 challenge keys, the unpadded base64url
+// encoding of a SHA-256 digest. It is matched against values decoded from
+// valueEncoding; other TXT values are never treated as orphans.
+var acmeValuePattern = regexp.MustCompile(`^[A-Za-z0-9_-]{43}$`)
+
+// activeKeys tracks the challenge keys presented and not yet cleaned up, per
+// FQDN, so orphan cleanup leaves challenges in progress for the same name
+// alone. Keys are dropped after limits.ttl, or the oldest ones once there
+// are more than limits.maxEntries. A nil *activeKeys tracks nothing.
+type activeKeys struct {
+	mu     sync.Mutex
+	keys   map[recordIDKey]time.Time
+	limits stateLimits
+}
+
+func newActiveKeys() *activeKeys {
+	return &activeKeys{keys: map[recordIDKey]time.Time{}, limits: defaultStateLimits()}
+}
+
+// add marks key as active at fqdn and returns the other keys that already
+// were, checked under the same lock so concurrent presents see each other.
+func (a *activeKeys) add(fqdn, key string) (others []string) {
+	if a == nil {
+		return nil
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	fqdn = normalizeDomain(fqdn)
+	others = a.othersLocked(fqdn, key)
+	a.keys[recordIDKey{fqdn, key}] = a.limits.now()
+	evict(a.keys, a.limits, func(added time.Time) time.Time { return added }, "active challenges")
+	return others
+}
+
+func (a *activeKeys) remove(fqdn, key string) {
+	if a == nil {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	delete(a.keys, recordIDKey{normalizeDomain(fqdn), key})
+}
+
+func (a *activeKeys) has(fqdn, key string) bool {
+	if a == nil {
+		return false
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	_, ok := a.keys[recordIDKey{normalizeDomain(fqdn), key}]
+	return ok
+}
+
+// all returns the keys active at any FQDN.
+func (a *activeKeys) all() []string {
+	if a == nil {
+		return nil
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	keys := make([]string, 0, len(a.keys))
+	for k := range a.keys {
+		keys = append(keys, k.key)
+	}
+	return keys
+}
+
+// hasOthers reports whether a key other than key is active at fqdn.
+func (a *activeKeys) hasOthers(fqdn, key string) bool {
+	if a == nil {
+		return false
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	return len(a.othersLocked(normalizeDomain(fqdn), key)) > 0
+}
+
+// othersLocked returns the sorted keys other than key active at the
+// normalized fqdn. a.mu must be held.
+func (a *activeKeys) othersLocked(fqdn, key string) []string {
+	var others []string
+	for k := range a.keys {
+		if k.fqdn == fqdn && k.key != key {
+			others = append(others, k.key)
+		}
+	}
+	slices.Sort(others)
+	return others
+}
+
+// cleanupOrphans removes challenge values left at the challenge FQDN by
+// earlier runs, e.g. when the webhook died between present and cleanup. Only
+// values whose key, decoded from valueEncoding, is shaped like a challenge
+// key and not in use by a challenge of this solver are removed; all removals
+// are attempted and their failures reported together.
+//
+// In test mode with a testValue deletes send the test value instead of the
+// orphan's key, so orphans are left alone.
+func (c *domainOffensiveDNSProviderSolver) cleanupOrphans(ctx context.Context, client *http.Client, ch *v1alpha1.ChallengeRequest, cfg domainOffensiveDNSProviderConfig, token string) error {
+	if cfg.TestMode && cfg.TestValue != "" {
+		klog.Infof("test mode: not removing orphaned acme txt records at %v, deletes would send the test value", ch.ResolvedFQDN)
+		return nil
+	}
+	values, err := listChallengeValues(ctx, client, ch, cfg, token)
+	if err != nil {
+		return err
+	}
+
+	var errs []error
+	for _, v := range values {
+		key, ok := decodeValue(v, cfg.ValueEncoding)
+		if !ok || key == ch.Key || !acmeValuePattern.MatchString(key) || c.active.has(ch.ResolvedFQDN, key) {
+			continue
+		}
+		klog.Infof("removing orphaned acme txt record %v with value %q", ch.ResolvedFQDN, v)
+		orphan := *ch
+		orphan.Key = key
+		if err := deleteRecord(ctx, client, &orphan, cfg, token, nil); err != nil {
+			errs = append(errs, fmt.Errorf("removing orphaned value %q: %w", v, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// listChallengeValues returns the values stored at the challenge record. In
+// records mode they are listed through the API, as stored; the letsencrypt
+// endpoint cannot list records, so they are read from the nameservers
+// otherwise, as served.
+func listChallengeValues(ctx context.Context, client *http.Client, ch *v1alpha1.ChallengeRequest, cfg domainOffensiveDNSProviderConfig, token string) ([]string, error) {
+	rec, err := resolveChallengeRecord(ctx, ch, cfg)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkDomainAllowed(rec.fqdn, cfg.DomainAllowlist); err != nil {
+		return nil, err
+	}
+
+	if cfg.ApiMode != apiModeRecords {
+		values, err := lookupTXT(ctx, rec.fqdn, cfg.PropagationNameservers, cfg.resolvers())
+		if err != nil {
+			return nil, fmt.Errorf("unable to list TXT records at %s: %w", rec.fqdn, err)
+		}
+		return values, nil
+	}
+	api := recordsAPI{
+		client:    client,
+		ch:        ch,
+		cfg:       cfg,
+		token:     token,
+		zone:      normalizeDomain(cfg.zone(ch)),
+		operation: operationCleanup,
+	}
+	records, _, err := api.list(ctx, rec.name)
+	if err != nil {
+		return nil, fmt.Errorf("unable to list TXT records at %s: %w", rec.fqdn, redactSecretURLError(redactError(err, token), secretURL(cfg)))
+	}
+	values := make([]string, 0, len(records))
+	for _, r := range records {
+		values = append(values, r.Content)
+	}
+	return values, nil
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/cert-manager/cert-manager/pkg/issuer/acme/dns/util"
+	"github.com/miekg/dns"
+	"k8s.io/klog/v2"
+)
+
+// propagationPollInterval is the delay between two propagation checks.
+const propagationPollInterval = 5 * time.Second
+
+// waitForPropagation polls nameservers until all of them serve a TXT record
+// for fqdn with the given value, or until timeout elapses. Without explicit
+// nameservers the authoritative nameservers of the zone are polled, found
+// by querying resolvers for its SOA and NS records.
+func waitForPropagation(ctx context.Context, fqdn, value string, nameservers, resolvers []string, timeout time.Duration) error {
+	pollCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	discover := len(nameservers) == 0
+	if discover {
+		nameservers = resolvers
+	}
+
+	var lastErr error
+	for {
+		ok, err := util.PreCheckDNS(pollCtx, fqdn, value, nameservers, discover)
+		if ok {
+			if discover {
+				klog.Infof("TXT record %v has propagated to all authoritative nameservers", fqdn)
+			} else {
+				klog.Infof("TXT record %v has propagated to %v", fqdn, nameservers)
+			}
+			return nil
+		}
+		if err != nil {
+			lastErr = err
+		}
+
+		if err := sleepContext(pollCtx, propagationPollInterval); err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			if lastErr != nil {
+				return fmt.Errorf("TXT record %v did not propagate within %v: %v", fqdn, timeout, lastErr)
+			}
+			return fmt.Errorf("TXT record %v did not propagate within %v", fqdn, timeout)
+		}
+	}
+}
+
+// waitForDeletion polls nameservers until none of them serves value in the
+// TXT record for fqdn, or until timeout elapses. Without explicit
+// nameservers the authoritative nameservers of the zone are polled.
+func waitForDeletion(ctx context.Context, fqdn, value string, nameservers, resolvers []string, timeout time.Duration) error {
+	pollCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	var lastErr error
+	for {
+		served, err := servesTXTValue(pollCtx, fqdn, value, nameservers, resolvers)
+		if err == nil && !served {
+			klog.Infof("TXT value at %v is no longer served", fqdn)
+			return nil
+		}
+		lastErr = err
+
+		if err := sleepContext(pollCtx, propagationPollInterval); err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			if lastErr != nil {
+				return fmt.Errorf("%w: could not verify deletion at %v within %v: %v", ErrRecordNotDeleted, fqdn, timeout, lastErr)
+			}
+			return fmt.Errorf("%w: %v still serves the challenge value after %v", ErrRecordNotDeleted, fqdn, timeout)
+		}
+	}
+}
+
+// servesTXTValue reports whether any of nameservers, or of the authoritative
+// nameservers of the zone discovered through resolvers if none are given,
+// serves value for fqdn.
+func servesTXTValue(ctx context.Context, fqdn, value string, nameservers, resolvers []string) (bool, error) {
+	if len(nameservers) == 0 {
+		var err error
+		nameservers, err = authoritativeNameservers(ctx, dns.Fqdn(fqdn), resolvers)
+		if err != nil {
+			return false, err
+		}
+	}
+	for _, ns := range nameservers {
+		values, err := lookupTXT(ctx, fqdn, []string{ns}, nil)
+		if err != nil {
+			return false, err
+		}
+		if slices.Contains(values, value) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// nameserverAddress returns ns as host:port, defaulting to port 53.
+func nameserverAddress(ns string) (string, error) {
+	if ns == "" {
+		return "", errors.New("nameserver must not be empty")
+	}
+	host, port, err := net.SplitHostPort(ns)
+	if err != nil {
+		// no port given; this also covers bare IPv6 addresses
+		host, port = ns, "53"
+	}
+	if host == "" {
+		return "", fmt.Errorf("nameserver %q has no host", ns)
+	}
+	if _, err := strconv.ParseUint(port, 10, 16); err != nil {
+		return "", fmt.Errorf("nameserver %q has invalid port %q", ns, port)
+	}
+	return net.JoinHostPort(host, port), nil
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cert-manager/cert-manager/pkg/acme/webhook/apis/acme/v1alpha1"
+	"k8s.io/klog/v2"
+)
+
+// defaultReconcileMaxAge is the age from which a challenge record without an
+// active challenge counts as stale. Challenges rarely take more than minutes.
+const defaultReconcileMaxAge = time.Hour
+
+// reconciler periodically removes stale challenge records, e.g. left behind
+// by a crash between present and cleanup, from the zones the solver presented
+// records to. Stale records are found by listing the zone, so only zones
+// managed in apiMode records are reconciled. It is disabled unless
+// RECONCILE_INTERVAL is set. A nil *reconciler tracks nothing.
+type reconciler struct {
+	interval time.Duration
+	maxAge   time.Duration
+	now      func() time.Time
+
+	mu      sync.Mutex
+	targets map[reconcileKey]reconcileTarget
+}
+
+type reconcileKey struct {
+	namespace string
+	zone      string
+}
+
+// reconcileTarget is a zone to reconcile, along with the config it was last
+// presented to with, which also names the token.
+type reconcileTarget struct {
+	ch  *v1alpha1.ChallengeRequest
+	cfg domainOffensiveDNSProviderConfig
+}
+
+// newReconcilerFromEnv reads RECONCILE_INTERVAL and RECONCILE_MAX_AGE. It
+// returns nil if RECONCILE_INTERVAL is unset.
+func newReconcilerFromEnv() (*reconciler, error) {
+	v := os.Getenv("RECONCILE_INTERVAL")
+	if v == "" {
+		return nil, nil
+	}
+	interval, err := time.ParseDuration(v)
+	if err != nil || interval <= 0 {
+		return nil, fmt.Errorf("RECONCILE_INTERVAL must be a positive duration, got %q", v)
+	}
+
+	maxAge := defaultReconcileMaxAge
+	if v := os.Getenv("RECONCILE_MAX_AGE"); v != "" {
+		maxAge, err = time.ParseDuration(v)
+		if err != nil || maxAge <= 0 {
+			return nil, fmt.Errorf("RECONCILE_MAX_AGE must be a positive duration, got %q", v)
+		}
+	}
+	return newReconciler(interval, maxAge), nil
+}
+
+func newReconciler(interval, maxAge time.Duration) *reconciler {
+	return &reconciler{interval: interval, maxAge: maxAge, now: time.Now, targets: map[reconcileKey]reconcileTarget{}}
+}
+
+// track adds the zone of ch to the zones to reconcile, if cfg manages it
+// through the records API.
+func (r *reconciler) track(ch *v1alpha1.ChallengeRequest, cfg domainOffensiveDNSProviderConfig) {
+	if r == nil || cfg.ApiMode != apiModeRecords {
+		return
+	}
+	zone := normalizeDomain(cfg.zone(ch))
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.targets[reconcileKey{ch.ResourceNamespace, zone}] = reconcileTarget{
+		ch: &v1alpha1.ChallengeRequest{
+			ResourceNamespace: ch.ResourceNamespace,
+			ResolvedZone:      ch.ResolvedZone,
+			ResolvedFQDN:      ch.ResolvedZone,
+			Config:            ch.Config,
+		},
+		cfg: cfg,
+	}
+}
+
+func (r *reconciler) snapshot() []reconcileTarget {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	targets := make([]reconcileTarget, 0, len(r.targets))
+	for _, t := range r.targets {
+		targets = append(targets, t)
+	}
+	return targets
+}
+
+// runReconciler reconciles the tracked zones every interval until ctx is
+// done.
+func (c *domainOffensiveDNSProviderSolver) runReconciler(ctx context.Context) {
+	ticker := time.NewTicker(c.reconciler.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := c.reconcile(ctx); err != nil {
+				klog.Errorf("reconciling stale acme txt records: %v", err)
+			}
+		}
+	}
+}
+
+// reconcile removes stale challenge records from every tracked zone and
+// reports the failures of all zones together.
+func (c *domainOffensiveDNSProviderSolver) reconcile(ctx context.Context) error {
+	var errs []error
+	for _, t := range c.reconciler.snapshot() {
+		if err := c.reconcileZone(ctx, t); err != nil {
+			errs = append(errs, fmt.Errorf("zone %s: %w", normalizeDomain(t.cfg.zone(t.ch)), err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// reconcileZone lists the TXT records of the zone and deletes the challenge
+// records older than maxAge whose value is not that of a challenge in
+// progress. Records the API reports without a creation time are kept, as
+// their age is unknown.
+func (c *domainOffensiveDNSProviderSolver) reconcileZone(ctx context.Context, t reconcileTarget) error {
+	cfg := t.cfg
+	token, err := c.loadSecrets(ctx, t.ch, &cfg)
+	if err != nil {
+		return err
+	}
+	client, err := c.apiClient(cfg)
+	if err != nil {
+		return err
+	}
+	api := recordsAPI{
+		client:    client,
+		ch:        t.ch,
+		cfg:       cfg,
+		token:     token,
+		zone:      normalizeDomain(cfg.zone(t.ch)),
+		operation: operationCleanup,
+	}
+	records, _, err := api.list(ctx, "")
+	if err != nil {
+		return redactError(err, token)
+	}
+
+	inUse := map[string]bool{}
+	for _, key := range c.active.all() {
+		inUse[encodeValue(key, cfg.ValueEncoding)] = true
+	}
+	var errs []error
+	for _, rec := range records {
+		if !isChallengeRecordName(rec.Name, cfg.RecordNamePrefix) || inUse[rec.Content] {
+			continue
+		}
+		created, err := time.Parse(time.RFC3339, rec.Created)
+		if err != nil {
+			klog.V(2).Infof("keeping acme txt record %s without a valid creation time %q", rec.Name, rec.Created)
+			continue
+		}
+		if age := c.reconciler.now().Sub(created); age < c.reconciler.maxAge {
+			continue
+		}
+		if err := checkDomainAllowed(recordFQDN(rec.Name, api.zone, cfg.RecordNameFormat), cfg.DomainAllowlist); err != nil {
+			klog.V(2).Infof("keeping stale acme txt record %s: %v", rec.Name, err)
+			continue
+		}
+		id := rawString(rec.ID)
+		klog.Infof("removing stale acme txt record %s (id %s) created at %s", rec.Name, id, rec.Created)
+		if _, err := api.delete(ctx, id); ignoreNotFound(err) != nil {
+			errs = append(errs, fmt.Errorf("removing stale record %s: %w", rec.Name, redactError(err, token)))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// isChallengeRecordName reports whether name, as sent to the API, starts
+// with the _acme-challenge label, or prefix if set.
+func isChallengeRecordName(name, prefix string) bool {
+	label, _, _ := strings.Cut(name, ".")
+	return label == challengeLabel || (prefix != "" && label == prefix)
+}
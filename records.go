@@ -0,0 +1,81 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/cert-manager/cert-manager/pkg/acme/webhook/apis/acme/v1alpha1"
+)
+
+// recordIDStore tracks the records that were presented and not cleaned up
+// yet, keyed by FQDN and challenge key, along with the ID the API returned
+// for them so cleanup can delete exactly that record. It only lives in
+// memory; records presented before a restart are deleted by value. Records
+// are dropped after limits.ttl, or the oldest ones once there are more than
+// limits.maxEntries, and then deleted by value too. A nil *recordIDStore
+// stores nothing.
+type recordIDStore struct {
+	mu      sync.Mutex
+	records map[recordIDKey]presentedRecord
+	limits  stateLimits
+}
+
+type recordIDKey struct {
+	fqdn string
+	key  string
+}
+
+// presentedRecord is a record that is waiting for cleanup.
+type presentedRecord struct {
+	ch *v1alpha1.ChallengeRequest
+	// id is the record ID reported by the API, or "" if it reported none.
+	id    string
+	added time.Time
+}
+
+func newRecordIDStore() *recordIDStore {
+	return &recordIDStore{records: map[recordIDKey]presentedRecord{}, limits: defaultStateLimits()}
+}
+
+func (s *recordIDStore) put(ch *v1alpha1.ChallengeRequest, id string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.records[recordIDKey{normalizeDomain(ch.ResolvedFQDN), ch.Key}] = presentedRecord{ch: ch, id: id, added: s.limits.now()}
+	evict(s.records, s.limits, func(r presentedRecord) time.Time { return r.added }, "presented records")
+}
+
+// get returns the ID of the record, or "" if it is not known.
+func (s *recordIDStore) get(fqdn, key string) string {
+	if s == nil {
+		return ""
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.records[recordIDKey{normalizeDomain(fqdn), key}].id
+}
+
+func (s *recordIDStore) remove(fqdn, key string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.records, recordIDKey{normalizeDomain(fqdn), key})
+}
+
+// outstanding returns the challenges of all records not cleaned up yet.
+func (s *recordIDStore) outstanding() []*v1alpha1.ChallengeRequest {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	chs := make([]*v1alpha1.ChallengeRequest, 0, len(s.records))
+	for _, r := range s.records {
+		chs = append(chs, r.ch)
+	}
+	return chs
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"github.com/cert-manager/cert-manager/pkg/acme/webhook/apis/acme/v1alpha1"
+	"k8s.io/klog/v2"
+)
+
+// Supported values for the apiMode config field.
+const (
+	// apiModeLetsEncrypt uses the letsencrypt shortcut endpoint, see
+	// callDoApi.
+	apiModeLetsEncrypt = "letsencrypt"
+	// apiModeRecords uses the general record management API, see
+	// callRecordsApi.
+	apiModeRecords = "records"
+)
+
+// defaultRecordsApiURL is the base of the record management API.
+const defaultRecordsApiURL = "https://my.do.de/api/dns"
+
+// callAPI applies action to the TXT record set at the challenge FQDN through
+// the API selected by apiMode.
+func callAPI(ctx context.Context, client *http.Client, ch *v1alpha1.ChallengeRequest, cfg domainOffensiveDNSProviderConfig, token string, action recordAction, recordID string) (string, error) {
+	if cfg.ApiMode == apiModeRecords {
+		return callRecordsApi(ctx, client, ch, cfg, token, action, recordID)
+	}
+	return callDoApi(ctx, client, ch, cfg, token, action, recordID)
+}
+
+// callRecordsApi applies action through do.de's record management API, which
+// manages the single records of a zone:
+//
+//	GET    <apiUrl>/zones/<zone>/records?name=<name>&type=TXT  lists records
+//	POST   <apiUrl>/zones/<zone>/records                       creates one
+//	DELETE <apiUrl>/zones/<zone>/records/<id>                  deletes one
+//
+// Records are created from a JSON body with name, type, content and ttl.
+// Responses carry the success and error fields parseAPIResponse knows, with
+// the created record under "record" and listed ones under "records". It
+// returns the ID of a created record.
+//
+// Deleting a record whose ID is not known lists the records at the name and
+// deletes those holding the challenge value, or all of them for actionClear,
+// so values of other challenges are left alone as with the letsencrypt
+// endpoint.
+func callRecordsApi(ctx context.Context, client *http.Client, ch *v1alpha1.ChallengeRequest, cfg domainOffensiveDNSProviderConfig, token string, action recordAction, recordID string) (createdID string, err error) {
+	operation := operationName(action)
+	var endpoint string
+	ctx, finish := observeAPICall(ctx, ch, cfg, token, action)
+	defer func() { err = finish(endpoint, err) }()
+
+	rec, err := resolveChallengeRecord(ctx, ch, cfg)
+	if err != nil {
+		return "", err
+	}
+	api := recordsAPI{
+		client:    client,
+		ch:        ch,
+		cfg:       cfg,
+		token:     token,
+		zone:      normalizeDomain(cfg.zone(ch)),
+		operation: operation,
+	}
+	mapping := url.Values{"domain": {rec.name}, "type": {cfg.RecordType}}
+	switch {
+	case action == actionDelete && recordID != "":
+		mapping.Set("record_id", recordID)
+	case action != actionClear:
+		mapping.Set("value", rec.value)
+	}
+	klog.V(2).InfoS("mapped challenge to api parameters", requestMapping(operation, ch, mapping)...)
+
+	if action == actionPresent {
+		created, e, err := api.create(ctx, rec)
+		endpoint = e
+		return rawString(created.ID), err
+	}
+	if action == actionDelete && recordID != "" {
+		endpoint, err = api.delete(ctx, recordID)
+		return "", err
+	}
+
+	records, endpoint, err := api.list(ctx, rec.name)
+	if err != nil {
+		return "", err
+	}
+	matched := 0
+	for _, r := range records {
+		if action == actionDelete && r.Content != rec.value {
+			continue
+		}
+		matched++
+		if endpoint, err = api.delete(ctx, rawString(r.ID)); ignoreNotFound(err) != nil {
+			return "", err
+		}
+	}
+	if matched == 0 && !cfg.DryRun {
+		klog.Infof("no acme txt record to delete at %v", ch.ResolvedFQDN)
+	}
+	return "", nil
+}
+
+// recordsAPI sends the requests of one callRecordsApi call.
+type recordsAPI struct {
+	client    *http.Client
+	ch        *v1alpha1.ChallengeRequest
+	cfg       domainOffensiveDNSProviderConfig
+	token     string
+	zone      string
+	operation string
+}
+
+// apiRecord is a record as the record management API reports it.
+type apiRecord struct {
+	// ID is kept raw, as it may be reported as a number or a string.
+	ID      json.RawMessage `json:"id"`
+	Name    string          `json:"name"`
+	Type    string          `json:"type"`
+	Content string          `json:"content"`
+	// Created is the RFC 3339 creation time, if the API reports it.
+	Created string `json:"created_at"`
+}
+
+// newRecord is the body of a create request.
+type newRecord struct {
+	Name    string `json:"name"`
+	Type    string `json:"type"`
+	Content string `json:"content"`
+	TTL     int    `json:"ttl,omitempty"`
+}
+
+// recordsResponse holds the fields a record management API response may
+// carry besides the success and error fields.
+type recordsResponse struct {
+	Record  apiRecord   `json:"record"`
+	Records []apiRecord `json:"records"`
+}
+
+func (a recordsAPI) create(ctx context.Context, rec challengeRecord) (apiRecord, string, error) {
+	body, err := json.Marshal(newRecord{Name: rec.name, Type: a.cfg.RecordType, Content: rec.value, TTL: a.cfg.RecordTTL})
+	if err != nil {
+		return apiRecord{}, "", fmt.Errorf("encoding record: %w", err)
+	}
+	resp, endpoint, err := a.send(ctx, http.MethodPost, "", url.Values{}, body)
+	return resp.Record, endpoint, err
+}
+
+// list returns the records of the record type at name, or in the whole zone
+// if name is empty.
+func (a recordsAPI) list(ctx context.Context, name string) ([]apiRecord, string, error) {
+	q := url.Values{"type": {a.cfg.RecordType}}
+	if name != "" {
+		q.Set("name", name)
+	}
+	resp, endpoint, err := a.send(ctx, http.MethodGet, "", q, nil)
+	return resp.Records, endpoint, err
+}
+
+func (a recordsAPI) delete(ctx context.Context, id string) (string, error) {
+	_, endpoint, err := a.send(ctx, http.MethodDelete, id, url.Values{}, nil)
+	return endpoint, err
+}
+
+// send makes a request to the records collection of the zone, or to the
+// record with the given ID, and decodes the response. A 404 status is
+// reported as an API error about a missing record.
+func (a recordsAPI) send(ctx context.Context, method, id string, q url.Values, body []byte) (recordsResponse, string, error) {
+	elems := []string{"zones", a.zone, "records"}
+	if id != "" {
+		elems = append(elems, url.PathEscape(id))
+	}
+	endpoints := make([]string, len(a.cfg.ApiURL))
+	for i, base := range a.cfg.ApiURL {
+		endpoint, err := url.JoinPath(base, elems...)
+		if err != nil {
+			return recordsResponse{}, "", fmt.Errorf("building records api url for %s: %w", base, err)
+		}
+		endpoints[i] = endpoint
+	}
+
+	areq := apiRequest{
+		method: method,
+		params: q,
+		header: apiHeader(a.cfg, a.token, q),
+		token:  a.token,
+		body:   body,
+
+		secretURL:   secretURL(a.cfg),
+		maxBodySize: a.cfg.MaxResponseBodySize,
+	}
+	if a.cfg.DryRun {
+		areq.url = endpoints[0]
+		klog.Infof("dry run: not sending %s request for %v: %v", a.operation, a.ch.ResolvedFQDN, areq)
+		return recordsResponse{}, "", nil
+	}
+
+	resp, endpoint, err := sendWithRetries(ctx, a.client, a.ch, a.cfg, areq, endpoints, a.operation)
+	if err != nil {
+		return recordsResponse{}, endpoint, err
+	}
+	if resp.statusCode == http.StatusNotFound {
+		var apiErr *apiError
+		if _, err := parseAPIResponse(resp.body); errors.As(err, &apiErr) {
+			return recordsResponse{}, endpoint, apiErr
+		}
+		return recordsResponse{}, endpoint, &apiError{Message: "record not found", Body: string(resp.body)}
+	}
+	if resp.statusCode < 200 || resp.statusCode >= 300 {
+		return recordsResponse{}, endpoint, fmt.Errorf("%w: api status %d: %s", ErrAPIFailure, resp.statusCode, string(resp.body))
+	}
+	if len(resp.body) == 0 {
+		return recordsResponse{}, endpoint, nil
+	}
+	result, err := parseAPIResponse(resp.body)
+	if err != nil {
+		return recordsResponse{}, endpoint, err
+	}
+	if !result.known {
+		if err := handleMissingSuccess(a.ch, a.cfg, resp, a.token); err != nil {
+			return recordsResponse{}, endpoint, err
+		}
+	}
+	var decoded recordsResponse
+	if err := json.Unmarshal(resp.body, &decoded); err != nil {
+		return recordsResponse{}, endpoint, fmt.Errorf("%w: error decoding api response: %w (body=%s)", ErrAPIFailure, err, string(resp.body))
+	}
+	return decoded, endpoint, nil
+}
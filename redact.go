@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"net/url"
+	"strings"
+)
+
+// redactedPlaceholder replaces secrets in logged values.
+const redactedPlaceholder = "***"
+
+// redactToken replaces every occurrence of token in s, in plain as well as
+// URL-encoded form, so it can be surfaced in errors and logs.
+func redactToken(s, token string) string {
+	if token == "" {
+		return s
+	}
+	s = strings.ReplaceAll(s, token, redactedPlaceholder)
+	if escaped := url.QueryEscape(token); escaped != token {
+		s = strings.ReplaceAll(s, escaped, redactedPlaceholder)
+	}
+	return s
+}
+
+// secretURL returns the API URL if it was read from apiUrlSecretKeyRef, so
+// it can be redacted from logs and errors like a token, or "" otherwise.
+func secretURL(cfg domainOffensiveDNSProviderConfig) string {
+	if cfg.ApiURLSecretKeyRef == nil || len(cfg.ApiURL) == 0 {
+		return ""
+	}
+	return strings.TrimSuffix(cfg.ApiURL[0], "/")
+}
+
+// secretURLParts returns the strings that reveal a secret API URL: the URL
+// itself and its host, which dial, DNS and TLS errors show on their own.
+func secretURLParts(apiURL string) []string {
+	if apiURL == "" {
+		return nil
+	}
+	parts := []string{apiURL}
+	if u, err := url.Parse(apiURL); err == nil && u.Host != "" {
+		parts = append(parts, u.Host, u.Hostname())
+	}
+	return parts
+}
+
+// redactSecretURL replaces a secret API URL and its host in s.
+func redactSecretURL(s, apiURL string) string {
+	for _, part := range secretURLParts(apiURL) {
+		s = redactToken(s, part)
+	}
+	return s
+}
+
+// redactSecretURLError wraps err so that its message does not reveal a
+// secret API URL or its host.
+func redactSecretURLError(err error, apiURL string) error {
+	for _, part := range secretURLParts(apiURL) {
+		err = redactError(err, part)
+	}
+	return err
+}
+
+type secretHostKey struct{}
+
+// withSecretHost marks requests made with ctx as going to a host read from
+// apiUrlSecretKeyRef, which the transport then keeps out of its logs,
+// errors and metrics.
+func withSecretHost(ctx context.Context) context.Context {
+	return context.WithValue(ctx, secretHostKey{}, true)
+}
+
+// shownHost returns host as the transport may show it for requests made
+// with ctx.
+func shownHost(ctx context.Context, host string) string {
+	if secret, _ := ctx.Value(secretHostKey{}).(bool); secret {
+		return redactedPlaceholder
+	}
+	return host
+}
+
+// redactedError hides a token in the message of the wrapped error, which
+// remains reachable through errors.Is and errors.As.
+type redactedError struct {
+	err   error
+	token string
+}
+
+// redactError wraps err so that its message does not reveal token.
+func redactError(err error, token string) error {
+	if err == nil || token == "" {
+		return err
+	}
+	return &redactedError{err: err, token: token}
+}
+
+func (e *redactedError) Error() string {
+	return redactToken(e.err.Error(), e.token)
+}
+
+func (e *redactedError) Unwrap() error {
+	return e.err
+}
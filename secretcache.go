@@ -0,0 +1,106 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// secretCache keeps recently read secret data in memory so that bursts of
+// challenges do not fetch the same secret over and over. Expired entries are
+// wiped and dropped on every access so their contents are not retained
+// longer than the TTL. A nil *secretCache caches nothing.
+type secretCache struct {
+	mu      sync.Mutex
+	entries map[string]secretCacheEntry
+	now     func() time.Time
+}
+
+type secretCacheEntry struct {
+	data    map[string][]byte
+	expires time.Time
+}
+
+func newSecretCache() *secretCache {
+	return &secretCache{
+		entries: map[string]secretCacheEntry{},
+		now:     time.Now,
+	}
+}
+
+// secretCacheKey returns the cache key of a secret.
+func secretCacheKey(namespace, name string) string {
+	return namespace + "/" + name
+}
+
+// get returns a copy of the cached data for key, if present and unexpired.
+func (c *secretCache) get(key string) (map[string][]byte, bool) {
+	if c == nil {
+		return nil, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.evictExpiredLocked()
+	e, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	return copySecretData(e.data), true
+}
+
+// put caches a copy of data under key for ttl.
+func (c *secretCache) put(key string, data map[string][]byte, ttl time.Duration) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.evictExpiredLocked()
+	if old, ok := c.entries[key]; ok {
+		wipeSecretData(old.data)
+	}
+	c.entries[key] = secretCacheEntry{
+		data:    copySecretData(data),
+		expires: c.now().Add(ttl),
+	}
+}
+
+// invalidate drops the entry for key.
+func (c *secretCache) invalidate(key string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if e, ok := c.entries[key]; ok {
+		wipeSecretData(e.data)
+		delete(c.entries, key)
+	}
+}
+
+func (c *secretCache) evictExpiredLocked() {
+	now := c.now()
+	for key, e := range c.entries {
+		if now.After(e.expires) {
+			wipeSecretData(e.data)
+			delete(c.entries, key)
+		}
+	}
+}
+
+func copySecretData(data map[string][]byte) map[string][]byte {
+	out := make(map[string][]byte, len(data))
+	for k, v := range data {
+		out[k] = append([]byte(nil), v...)
+	}
+	return out
+}
+
+// wipeSecretData overwrites the secret values before they are released.
+func wipeSecretData(data map[string][]byte) {
+	for _, v := range data {
+		clear(v)
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/cert-manager/cert-manager/pkg/acme/webhook/apis/acme/v1alpha1"
+	extapi "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+	"k8s.io/klog/v2"
+)
+
+// selfTestFromEnv returns the challenge for the startup self-test, or nil if
+// SELF_TEST_ZONE is not set. The self-test presents and cleans up a record
+// at a random name below SELF_TEST_ZONE, using the solver config in
+// SELF_TEST_CONFIG with secrets from SELF_TEST_NAMESPACE.
+func selfTestFromEnv() (*v1alpha1.ChallengeRequest, error) {
+	zone := os.Getenv("SELF_TEST_ZONE")
+	if zone == "" {
+		return nil, nil
+	}
+	namespace := os.Getenv("SELF_TEST_NAMESPACE")
+	if namespace == "" {
+		return nil, errors.New("SELF_TEST_NAMESPACE must be set when SELF_TEST_ZONE is set")
+	}
+	raw := &extapi.JSON{Raw: []byte(os.Getenv("SELF_TEST_CONFIG"))}
+	if _, err := loadConfig(raw); err != nil {
+		return nil, fmt.Errorf("invalid SELF_TEST_CONFIG: %w", err)
+	}
+
+	label := make([]byte, 4)
+	key := make([]byte, 32)
+	if _, err := rand.Read(label); err != nil {
+		return nil, err
+	}
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	zone = normalizeDomain(zone) + "."
+	return &v1alpha1.ChallengeRequest{
+		Key:               base64.RawURLEncoding.EncodeToString(key),
+		ResourceNamespace: namespace,
+		ResolvedZone:      zone,
+		ResolvedFQDN:      fmt.Sprintf("_acme-challenge.webhook-self-test-%s.%s", hex.EncodeToString(label), zone),
+		Config:            raw,
+	}, nil
+}
+
+// selfTest presents the record of ch and cleans it up again, to find
+// problems with the token or the zone before the first real challenge.
+func (c *domainOffensiveDNSProviderSolver) selfTest(ch *v1alpha1.ChallengeRequest) error {
+	klog.Infof("self-test: presenting acme txt record %v", ch.ResolvedFQDN)
+	if err := c.Present(ch); err != nil {
+		return fmt.Errorf("self-test present failed: %w", err)
+	}
+	if err := c.CleanUp(ch); err != nil {
+		return fmt.Errorf("self-test cleanup failed, record %v may be left behind: %w", ch.ResolvedFQDN, err)
+	}
+	klog.Infof("self-test succeeded: presented and cleaned up acme txt record %v", ch.ResolvedFQDN)
+	return nil
+}
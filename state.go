@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"slices"
+	"strconv"
+	"time"
+
+	"k8s.io/klog/v2"
+)
+
+// Defaults for the limits of the in-memory challenge state. A challenge
+// normally lives for minutes; entries older than a day point at a missed
+// cleanup.
+const (
+	defaultStateTTL        = 24 * time.Hour
+	defaultStateMaxEntries = 10000
+)
+
+// stateLimits bound the in-memory maps that track challenges, activeKeys and
+// recordIDStore, so a missed cleanup cannot make them grow without bound.
+// Entries older than ttl are evicted, and beyond maxEntries the oldest ones
+// are.
+type stateLimits struct {
+	ttl        time.Duration
+	maxEntries int
+	now        func() time.Time
+}
+
+func defaultStateLimits() stateLimits {
+	return stateLimits{ttl: defaultStateTTL, maxEntries: defaultStateMaxEntries, now: time.Now}
+}
+
+// newStateLimitsFromEnv reads STATE_TTL and STATE_MAX_ENTRIES.
+func newStateLimitsFromEnv() (stateLimits, error) {
+	limits := defaultStateLimits()
+	if v := os.Getenv("STATE_TTL"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			return limits, fmt.Errorf("STATE_TTL must be a positive duration, got %q", v)
+		}
+		limits.ttl = d
+	}
+	if v := os.Getenv("STATE_MAX_ENTRIES"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			return limits, fmt.Errorf("STATE_MAX_ENTRIES must be a positive integer, got %q", v)
+		}
+		limits.maxEntries = n
+	}
+	return limits, nil
+}
+
+// evict removes the entries of m added longer than l.ttl ago and, if more
+// than l.maxEntries remain, the oldest ones beyond that. name identifies m
+// in the debug log of each eviction.
+func evict[K comparable, V any](m map[K]V, l stateLimits, added func(V) time.Time, name string) {
+	now := l.now()
+	for k, v := range m {
+		if age := now.Sub(added(v)); age > l.ttl {
+			klog.V(2).Infof("evicting %v from %s, added %v ago", k, name, age.Round(time.Second))
+			delete(m, k)
+		}
+	}
+	if len(m) <= l.maxEntries {
+		return
+	}
+	keys := make([]K, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	slices.SortFunc(keys, func(a, b K) int { return added(m[a]).Compare(added(m[b])) })
+	for _, k := range keys[:len(keys)-l.maxEntries] {
+		klog.V(2).Infof("evicting %v from %s, more than %d entries", k, name, l.maxEntries)
+		delete(m, k)
+	}
+}
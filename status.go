@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"k8s.io/klog/v2"
+)
+
+// serveStatus serves the solver's status endpoints on port until ctx is
+// done.
+func serveStatus(ctx context.Context, port string, handler http.Handler) {
+	srv := &http.Server{
+		Addr:              net.JoinHostPort("", port),
+		Handler:           handler,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	go func() {
+		klog.Infof("serving status endpoints on %s", srv.Addr)
+		if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			klog.Errorf("status server stopped: %v", err)
+		}
+	}()
+	go func() {
+		<-ctx.Done()
+		_ = srv.Close()
+	}()
+}
+
+// configStore remembers the effective config last resolved for each
+// challenge namespace so operators can inspect defaults and overrides. A nil
+// *configStore records nothing.
+type configStore struct {
+	mu      sync.RWMutex
+	configs map[string]domainOffensiveDNSProviderConfig
+}
+
+func newConfigStore() *configStore {
+	return &configStore{configs: map[string]domainOffensiveDNSProviderConfig{}}
+}
+
+func (s *configStore) record(namespace string, cfg domainOffensiveDNSProviderConfig) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.configs[namespace] = cfg.redacted()
+}
+
+// ServeHTTP writes the recorded configs as JSON, keyed by namespace.
+func (s *configStore) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(s.configs); err != nil {
+		klog.Errorf("unable to encode solver configs: %v", err)
+	}
+}
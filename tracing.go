@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"os"
+
+	"github.com/cert-manager/cert-manager/pkg/acme/webhook/apis/acme/v1alpha1"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracer creates the solver's spans through the global tracer provider,
+// which does nothing unless setupTracing installed an exporter.
+var tracer = otel.Tracer("github.com/aewtemp/cert-manager-webhook-domain-offensive")
+
+// setupTracing exports spans over OTLP/gRPC if OTEL_EXPORTER_OTLP_ENDPOINT
+// or OTEL_EXPORTER_OTLP_TRACES_ENDPOINT is set. The exporter and the span
+// resource are configured through the standard OTEL_* environment
+// variables, e.g. OTEL_SERVICE_NAME. The returned function flushes pending
+// spans.
+func setupTracing(ctx context.Context) (shutdown func(context.Context) error, err error) {
+	if os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT") == "" && os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT") == "" {
+		return func(context.Context) error { return nil }, nil
+	}
+	exporter, err := otlptracegrpc.New(ctx)
+	if err != nil {
+		return nil, err
+	}
+	provider := sdktrace.NewTracerProvider(sdktrace.WithBatcher(exporter))
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	return provider.Shutdown, nil
+}
+
+// startSpan starts a span named name for the challenge.
+func startSpan(ctx context.Context, name string, ch *v1alpha1.ChallengeRequest) (context.Context, trace.Span) {
+	return tracer.Start(ctx, name, trace.WithAttributes(
+		attribute.String("fqdn", ch.ResolvedFQDN),
+		attribute.String("namespace", ch.ResourceNamespace),
+	))
+}
+
+// endSpan records the outcome of the challenge operation on span and ends
+// it. The zone is set here, as it may only be known after zone discovery.
+func endSpan(span trace.Span, ch *v1alpha1.ChallengeRequest, status string, err error) {
+	span.SetAttributes(
+		attribute.String("zone", ch.ResolvedZone),
+		attribute.String("result", status),
+	)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
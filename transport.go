@@ -0,0 +1,330 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+	"k8s.io/klog/v2"
+)
+
+// transportOptions are the solver config fields that shape the http
+// transport. Configs with equal options share one client, so connections are
+// reused across challenges.
+type transportOptions struct {
+	proxyURL string
+	caBundle string
+	// insecureSkipVerify disables verification of the API certificate.
+	insecureSkipVerify bool
+
+	maxIdleConns        int
+	maxIdleConnsPerHost int
+	idleConnTimeout     time.Duration
+
+	ipFamily string
+}
+
+func transportOptionsFor(cfg domainOffensiveDNSProviderConfig) transportOptions {
+	return transportOptions{
+		proxyURL: cfg.HTTPProxy,
+		caBundle: cfg.CABundle,
+
+		insecureSkipVerify: cfg.InsecureSkipVerify,
+
+		maxIdleConns:        cfg.MaxIdleConns,
+		maxIdleConnsPerHost: cfg.MaxIdleConnsPerHost,
+		idleConnTimeout:     cfg.IdleConnTimeout.Duration,
+
+		ipFamily: cfg.IPFamily,
+	}
+}
+
+// newAPIClient builds an http client for the given options.
+//
+// Proxy precedence: an explicit proxy URL is used for every request and
+// NO_PROXY is ignored; otherwise HTTPS_PROXY, HTTP_PROXY and NO_PROXY from
+// the environment apply. Zero pool options keep the http.DefaultTransport
+// settings.
+func newAPIClient(opts transportOptions) (*http.Client, error) {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.Proxy = http.ProxyFromEnvironment
+	if opts.proxyURL != "" {
+		u, err := parseProxyURL(opts.proxyURL)
+		if err != nil {
+			return nil, err
+		}
+		t.Proxy = http.ProxyURL(u)
+	}
+	t.DialContext = dialContext(opts.ipFamily)
+	if opts.maxIdleConns > 0 {
+		t.MaxIdleConns = opts.maxIdleConns
+	}
+	if opts.maxIdleConnsPerHost > 0 {
+		t.MaxIdleConnsPerHost = opts.maxIdleConnsPerHost
+	}
+	if opts.idleConnTimeout > 0 {
+		t.IdleConnTimeout = opts.idleConnTimeout
+	}
+	if opts.caBundle != "" || opts.insecureSkipVerify {
+		t.TLSClientConfig = &tls.Config{MinVersion: tls.VersionTLS12, InsecureSkipVerify: opts.insecureSkipVerify}
+	}
+	if opts.caBundle != "" {
+		pool, err := loadCABundle(opts.caBundle)
+		if err != nil {
+			return nil, err
+		}
+		t.TLSClientConfig.RootCAs = pool
+	}
+	return &http.Client{Transport: t, CheckRedirect: refuseRedirect}, nil
+}
+
+// refuseRedirect stops the client at redirects, which are returned to
+// callDoApi as is. Following them would drop the body of POST requests and
+// could send the token to another host, so the user is asked to update
+// apiUrl instead.
+func refuseRedirect(*http.Request, []*http.Request) error {
+	return http.ErrUseLastResponse
+}
+
+// dialContext returns a dial function that only uses addresses of the given
+// ipFamily, or any family for ipFamilyAuto, and logs the family of each
+// connection, hiding the addresses of a host read from a secret.
+func dialContext(ipFamily string) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	// the same settings as http.DefaultTransport
+	dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		switch ipFamily {
+		case ipFamilyIPv4:
+			network = "tcp4"
+		case ipFamilyIPv6:
+			network = "tcp6"
+		}
+		conn, err := dialer.DialContext(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		klog.V(2).Infof("connected to %s at %s using %s",
+			shownHost(ctx, addr), shownHost(ctx, conn.RemoteAddr().String()), addressFamily(conn.RemoteAddr()))
+		return conn, nil
+	}
+}
+
+// addressFamily returns ipFamilyIPv4 or ipFamilyIPv6 for a TCP address.
+func addressFamily(addr net.Addr) string {
+	if tcp, ok := addr.(*net.TCPAddr); ok && tcp.IP.To4() == nil {
+		return ipFamilyIPv6
+	}
+	return ipFamilyIPv4
+}
+
+// loadCABundle returns the system trust pool extended by the certificates in
+// bundle, which is either inline PEM or the path to a PEM file.
+func loadCABundle(bundle string) (*x509.CertPool, error) {
+	data := []byte(bundle)
+	if !strings.HasPrefix(strings.TrimSpace(bundle), "-----BEGIN") {
+		var err error
+		data, err = os.ReadFile(bundle)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read caBundle file %q: %v", bundle, err)
+		}
+	}
+
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		pool = x509.NewCertPool()
+	}
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("caBundle contains no valid PEM certificates")
+	}
+	return pool, nil
+}
+
+// parseProxyURL validates a proxy URL from the solver config.
+func parseProxyURL(raw string) (*url.URL, error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, fmt.Errorf("invalid httpProxy %q: %v", raw, err)
+	}
+	switch u.Scheme {
+	case "http", "https", "socks5":
+	default:
+		return nil, fmt.Errorf("httpProxy must use http, https or socks5, got scheme %q", u.Scheme)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("httpProxy %q has no host", raw)
+	}
+	return u, nil
+}
+
+// rateLimitedTransport delays requests until limiter admits them, giving up
+// when the request context is done.
+type rateLimitedTransport struct {
+	next    http.RoundTripper
+	limiter *rate.Limiter
+}
+
+func (t *rateLimitedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if err := t.limiter.Wait(req.Context()); err != nil {
+		return nil, fmt.Errorf("rate limit: %w", err)
+	}
+	return t.next.RoundTrip(req)
+}
+
+// newRateLimiterFromEnv returns the limiter shared by all API clients,
+// admitting API_RATE_LIMIT requests per second with bursts of
+// API_RATE_BURST. It returns nil if API_RATE_LIMIT is not set.
+func newRateLimiterFromEnv() (*rate.Limiter, error) {
+	v := os.Getenv("API_RATE_LIMIT")
+	if v == "" {
+		return nil, nil
+	}
+	limit, err := strconv.ParseFloat(v, 64)
+	if err != nil || limit <= 0 {
+		return nil, fmt.Errorf("API_RATE_LIMIT must be a positive number of requests per second, got %q", v)
+	}
+
+	burst := 1
+	if v := os.Getenv("API_RATE_BURST"); v != "" {
+		burst, err = strconv.Atoi(v)
+		if err != nil || burst < 1 {
+			return nil, fmt.Errorf("API_RATE_BURST must be a positive integer, got %q", v)
+		}
+	}
+	return rate.NewLimiter(rate.Limit(limit), burst), nil
+}
+
+// defaultMaxConcurrentRequests is the number of API requests that may be in
+// progress at once unless API_MAX_CONCURRENT says otherwise.
+const defaultMaxConcurrentRequests = 5
+
+// requestSemaphore caps the number of API requests in progress at once.
+type requestSemaphore chan struct{}
+
+// newRequestSemaphoreFromEnv returns the semaphore shared by all API
+// clients, admitting API_MAX_CONCURRENT requests at once.
+func newRequestSemaphoreFromEnv() (requestSemaphore, error) {
+	n := defaultMaxConcurrentRequests
+	if v := os.Getenv("API_MAX_CONCURRENT"); v != "" {
+		var err error
+		n, err = strconv.Atoi(v)
+		if err != nil || n < 1 {
+			return nil, fmt.Errorf("API_MAX_CONCURRENT must be a positive integer, got %q", v)
+		}
+	}
+	return make(requestSemaphore, n), nil
+}
+
+// acquire blocks until a request may be sent or ctx is done.
+func (s requestSemaphore) acquire(ctx context.Context) error {
+	select {
+	case s <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (s requestSemaphore) release() {
+	<-s
+}
+
+// concurrencyLimitedTransport holds a slot of sem from sending a request
+// until its response body is closed, so slow responses count against the
+// limit while they are read.
+type concurrencyLimitedTransport struct {
+	next http.RoundTripper
+	sem  requestSemaphore
+}
+
+func (t *concurrencyLimitedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if err := t.sem.acquire(req.Context()); err != nil {
+		return nil, fmt.Errorf("waiting for a free api request slot: %w", err)
+	}
+	resp, err := t.next.RoundTrip(req)
+	if err != nil {
+		t.sem.release()
+		return nil, err
+	}
+	resp.Body = &releasingBody{ReadCloser: resp.Body, release: sync.OnceFunc(t.sem.release)}
+	return resp, nil
+}
+
+// releasingBody calls release once the body is closed.
+type releasingBody struct {
+	io.ReadCloser
+	release func()
+}
+
+func (b *releasingBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.release()
+	return err
+}
+
+// clientCache holds one http client per distinct set of transport options.
+// If limiter is set, requests of all clients are throttled by it; if sem is
+// set, at most its capacity of requests are in progress at once; if
+// breakers is set, requests to failing hosts fail fast. A nil *clientCache
+// builds a new plain client on every call.
+type clientCache struct {
+	limiter  *rate.Limiter
+	sem      requestSemaphore
+	breakers *circuitBreakers
+
+	mu      sync.Mutex
+	clients map[transportOptions]*http.Client
+}
+
+func newClientCache(limiter *rate.Limiter, sem requestSemaphore, breakers *circuitBreakers) *clientCache {
+	return &clientCache{limiter: limiter, sem: sem, breakers: breakers, clients: map[transportOptions]*http.Client{}}
+}
+
+func (c *clientCache) get(opts transportOptions) (*http.Client, error) {
+	if c == nil {
+		return newAPIClient(opts)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if cl, ok := c.clients[opts]; ok {
+		return cl, nil
+	}
+	cl, err := newAPIClient(opts)
+	if err != nil {
+		return nil, err
+	}
+	// the breaker goes innermost, so only requests sent to the host count:
+	// running into the rate limit or waiting for a free slot says nothing
+	// about its health
+	if c.breakers != nil {
+		cl.Transport = &breakerTransport{next: cl.Transport, breakers: c.breakers}
+	}
+	if c.sem != nil {
+		cl.Transport = &concurrencyLimitedTransport{next: cl.Transport, sem: c.sem}
+	}
+	if c.limiter != nil {
+		cl.Transport = &rateLimitedTransport{next: cl.Transport, limiter: c.limiter}
+	}
+	c.clients[opts] = cl
+	return cl, nil
+}
+
+// redactURL hides the password of a URL, e.g. proxy credentials, for logging.
+func redactURL(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return raw
+	}
+	return u.Redacted()
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"runtime"
+
+	"k8s.io/klog/v2"
+)
+
+// Build information, set at build time with
+// -ldflags "-X main.version=... -X main.commit=... -X main.buildDate=...".
+var (
+	version   = "dev"
+	commit    = "unknown"
+	buildDate = "unknown"
+)
+
+// buildInfo describes the running binary.
+type buildInfo struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit"`
+	BuildDate string `json:"buildDate"`
+	GoVersion string `json:"goVersion"`
+}
+
+func currentBuildInfo() buildInfo {
+	return buildInfo{
+		Version:   version,
+		Commit:    commit,
+		BuildDate: buildDate,
+		GoVersion: runtime.Version(),
+	}
+}
+
+// logBuildInfo logs the build information once at startup, so it shows up
+// in the logs attached to bug reports.
+func logBuildInfo() {
+	info := currentBuildInfo()
+	klog.InfoS("Starting cert-manager-webhook-domain-offensive",
+		"version", info.Version,
+		"commit", info.Commit,
+		"buildDate", info.BuildDate,
+		"goVersion", info.GoVersion,
+	)
+}
+
+// serveVersion writes the build information as JSON.
+func serveVersion(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(currentBuildInfo()); err != nil {
+		klog.Errorf("unable to encode version: %v", err)
+	}
+}